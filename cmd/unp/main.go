@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/mattn/go-isatty"
 	"github.com/mpolden/unp/logutil"
@@ -25,10 +28,11 @@ func init() {
 }
 
 func main() {
-	var test bool
+	var test, force bool
 	var configFile string
 	flag.StringVar(&configFile, "f", "~/.unprc", "Path to config file")
 	flag.BoolVar(&test, "t", false, "Test and print config")
+	flag.BoolVar(&force, "force", false, "Unpack the given files or directories once, even if already unpacked, and exit")
 	flag.Parse()
 
 	cfg, err := watcher.ReadConfig(configFile)
@@ -46,5 +50,16 @@ func main() {
 	}
 
 	w := watcher.New(cfg)
+	if force {
+		if flag.NArg() == 0 {
+			log.Fatal("-force requires at least one file or directory")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := w.Force(ctx, flag.Args()...); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	w.Start()
 }
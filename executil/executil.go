@@ -2,11 +2,12 @@ package executil
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"html/template"
 	"os"
 	"os/exec"
 	"strings"
+	"text/template"
 )
 
 type CommandData struct {
@@ -15,31 +16,41 @@ type CommandData struct {
 	Name string
 }
 
-func compileCommand(tmpl string, data CommandData) (*exec.Cmd, error) {
-	t, err := template.New("cmd").Parse(tmpl)
+// Expand executes the template tmpl using data and returns the result.
+func Expand(tmpl string, data CommandData) (string, error) {
+	t, err := template.New("tmpl").Option("missingkey=error").Parse(tmpl)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	var b bytes.Buffer
 	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func compileCommand(ctx context.Context, tmpl string, data CommandData) (*exec.Cmd, error) {
+	s, err := Expand(tmpl, data)
+	if err != nil {
 		return nil, err
 	}
-	argv := strings.Split(b.String(), " ")
+	argv := strings.Split(s, " ")
 	if len(argv) == 0 {
 		return nil, fmt.Errorf("template compiled to empty command")
 	}
-	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
 	if _, err := os.Stat(data.Dir); err == nil {
 		cmd.Dir = data.Dir
 	}
 	return cmd, nil
 }
 
-func Run(command string, data CommandData) error {
+// Run runs command, after expanding it using data. The command is killed if ctx is done before it completes.
+func Run(ctx context.Context, command string, data CommandData) error {
 	if command == "" {
 		return nil
 	}
-	cmd, err := compileCommand(command, data)
+	cmd, err := compileCommand(ctx, command, data)
 	if err != nil {
 		return err
 	}
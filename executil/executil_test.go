@@ -1,10 +1,12 @@
 package executil
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCompileCommand(t *testing.T) {
@@ -15,7 +17,7 @@ func TestCompileCommand(t *testing.T) {
 		Base: "baz.rar",
 		Dir:  dir,
 	}
-	cmd, err := compileCommand(tmpl, data)
+	cmd, err := compileCommand(context.Background(), tmpl, data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,7 +42,42 @@ func TestCompileCommand(t *testing.T) {
 	if cmd.Args[4] != data.Dir {
 		t.Fatalf("want %q, got %q", data.Base, cmd.Args[4])
 	}
-	if _, err := compileCommand("tar -xf {{.Bar}}", data); err == nil {
+	if _, err := compileCommand(context.Background(), "tar -xf {{.Bar}}", data); err == nil {
 		t.Fatal("want error")
 	}
 }
+
+func TestExpand(t *testing.T) {
+	data := CommandData{Name: "/tmp/foo/bar & baz.rar", Base: "bar & baz.rar", Dir: "/tmp/foo"}
+	var tests = []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"/media/unpacked/{{.Base}}", "/media/unpacked/bar & baz.rar", false},
+		{"{{.Dir}}/unpacked", "/tmp/foo/unpacked", false},
+		{"/media/unpacked", "/media/unpacked", false},
+		{"/media/{{.Bar}}", "", true},
+		{"/media/{{.Base", "", true},
+	}
+	for _, tt := range tests {
+		got, err := Expand(tt.in, data)
+		if tt.err != (err != nil) {
+			t.Errorf("want error = %t, got %v for %q", tt.err, err, tt.in)
+		}
+		if got != tt.out {
+			t.Errorf("want %q, got %q", tt.out, got)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Run(ctx, "sleep 10", CommandData{}); err == nil {
+		t.Fatal("want error")
+	}
+	if err := ctx.Err(); err == nil {
+		t.Errorf("want context to be done")
+	}
+}
@@ -0,0 +1,312 @@
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const stagingPrefix = ".unp-staging-"
+
+// ErrInsufficientSpace is returned when a file system does not have enough free space.
+var ErrInsufficientSpace = errors.New("insufficient space")
+
+// ErrChanging is returned when files were modified too recently to be considered complete.
+var ErrChanging = errors.New("files are still changing")
+
+// StagingDir creates a new hidden staging directory in dir. Keeping the staging directory in dir ensures that it can
+// later be published to dir using a rename.
+func StagingDir(dir string) (string, error) { return os.MkdirTemp(dir, stagingPrefix) }
+
+func isStaging(name string) bool { return strings.HasPrefix(name, stagingPrefix) }
+
+// InStaging returns true if any component of path is a staging directory.
+func InStaging(path string) bool {
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		if isStaging(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish moves all files in the staging directory src into dst and removes src. Files are moved using rename, which
+// is atomic when src and dst are on the same file system. Directories that already exist in dst are merged. A file is
+// never moved over a file that appeared in dst after it was staged, unless the overwrite policy allows replacing it.
+// Files that were renamed or skipped due to the policy are returned, keyed by their slash-separated path relative to
+// src. The value is the new path relative to dst, or empty if the file was skipped.
+func Publish(src, dst, policy string) (map[string]string, error) {
+	moved := make(map[string]string)
+	if err := merge(src, dst, policy, "", moved); err != nil {
+		return nil, err
+	}
+	return moved, os.RemoveAll(src)
+}
+
+// renameExclusive renames from to to, failing with an error wrapping fs.ErrExist if to exists. Files are linked and
+// then unlinked, so that an existing file is never replaced. Directories cannot be linked, so they are renamed once to
+// is known to not exist.
+func renameExclusive(from, to string) error {
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if err := os.Link(from, to); err == nil {
+			return os.Remove(from)
+		} else if errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		// The file system does not support hard links
+	}
+	if _, err := os.Lstat(to); err == nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: fs.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// publishFile moves the staged file from to to. If a file exists at to, the overwrite policy decides whether it is
+// replaced, or whether from is renamed or skipped. The path from was moved to is returned, which is empty if from was
+// skipped.
+func publishFile(from, to, policy string, mtime time.Time) (string, error) {
+	name := to
+	for {
+		err := renameNoReplace(from, name)
+		if !errors.Is(err, fs.ErrExist) {
+			return name, err
+		}
+		fi, err := os.Lstat(name)
+		if err != nil {
+			return "", err
+		}
+		if fi.IsDir() {
+			return "", fmt.Errorf("cannot replace directory with file: %s", name)
+		}
+		// A file appeared after from was staged, so apply the policy again
+		resolved, err := ResolveConflict(policy, to, mtime)
+		if err != nil || resolved == "" {
+			return "", err
+		}
+		if resolved == name {
+			return name, os.Rename(from, name)
+		}
+		name = resolved
+	}
+}
+
+func merge(src, dst, policy, rel string, moved map[string]string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		from := filepath.Join(src, e.Name())
+		to := filepath.Join(dst, e.Name())
+		name := path.Join(rel, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if !e.IsDir() {
+			published, err := publishFile(from, to, policy, info.ModTime())
+			if err != nil {
+				return err
+			}
+			if published == "" {
+				moved[name] = ""
+			} else if published != to {
+				moved[name] = path.Join(rel, filepath.Base(published))
+			}
+			continue
+		}
+		if err := renameNoReplace(from, to); err == nil {
+			continue
+		} else if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		fi, err := os.Lstat(to)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("cannot replace file with directory: %s", to)
+		}
+		if err := merge(from, to, policy, name, moved); err != nil {
+			return err
+		}
+		// Merging modifies the existing directory, so restore the modification time of the staged one
+		if err := os.Chtimes(to, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckSettled returns an error wrapping ErrChanging if any of the named files was modified within d. Missing files
+// are ignored.
+func CheckSettled(names []string, d time.Duration) error {
+	now := time.Now()
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if age := now.Sub(fi.ModTime()); age < d {
+			return fmt.Errorf("%w: %s was modified %s ago", ErrChanging, name, age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// RemoveStaging removes staging directories found anywhere below root, such as those left behind by a crash. The
+// paths of the removed directories are returned.
+func RemoveStaging(root string) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !d.IsDir() || !isStaging(d.Name()) {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		removed = append(removed, path)
+		return filepath.SkipDir
+	})
+	return removed, err
+}
+
+const (
+	// OverwriteAlways replaces existing files.
+	OverwriteAlways = "always"
+	// OverwriteNever keeps existing files, skipping the new file.
+	OverwriteNever = "never"
+	// OverwriteIfNewer replaces existing files that are older than the new file.
+	OverwriteIfNewer = "if-newer"
+	// OverwriteRename keeps existing files, and writes the new file with a numbered suffix.
+	OverwriteRename = "rename"
+	// OverwriteFail fails when a file already exists.
+	OverwriteFail = "fail"
+)
+
+// IsOverwritePolicy returns whether policy is a valid overwrite policy. The empty string is treated as OverwriteAlways.
+func IsOverwritePolicy(policy string) bool {
+	switch policy {
+	case "", OverwriteAlways, OverwriteNever, OverwriteIfNewer, OverwriteRename, OverwriteFail:
+		return true
+	}
+	return false
+}
+
+// ResolveConflict decides where a file with modification time mtime should be written, given that it should be
+// written to name and the overwrite policy. The returned name differs from name if the file should be renamed, and is
+// empty if the file should be skipped.
+func ResolveConflict(policy, name string, mtime time.Time) (string, error) {
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+	switch policy {
+	case "", OverwriteAlways:
+		return name, nil
+	case OverwriteNever:
+		return "", nil
+	case OverwriteIfNewer:
+		if mtime.After(fi.ModTime()) {
+			return name, nil
+		}
+		return "", nil
+	case OverwriteRename:
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; ; i++ {
+			renamed := fmt.Sprintf("%s.%d%s", base, i, ext)
+			if _, err := os.Lstat(renamed); os.IsNotExist(err) {
+				return renamed, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+	case OverwriteFail:
+		return "", fmt.Errorf("file exists: %s", name)
+	}
+	return "", fmt.Errorf("invalid overwrite policy: %q", policy)
+}
+
+// WriteFile writes data to name atomically, by writing to a temporary file in the same directory and renaming it to
+// name.
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// ContainsSymlink returns whether any existing directory between root and name, excluding root and name themselves, is
+// a symbolic link.
+func ContainsSymlink(root, name string) (bool, error) {
+	rel, err := filepath.Rel(root, filepath.Dir(name))
+	if err != nil {
+		return false, err
+	}
+	if rel == "." {
+		return false, nil
+	}
+	path := root
+	for _, elem := range strings.Split(rel, string(os.PathSeparator)) {
+		path = filepath.Join(path, elem)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckSpace returns ErrInsufficientSpace if writing size bytes to dir would leave less than reserve bytes free on
+// its file system. The check is skipped on platforms where free space cannot be determined.
+func CheckSpace(dir string, size, reserve int64) error {
+	free, err := Free(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if need := size + reserve; need > 0 && uint64(need) > free {
+		return fmt.Errorf("%w: %s: need %d bytes (%d reserved), %d bytes free", ErrInsufficientSpace, dir, need,
+			reserve, free)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+)
+
+// Free is not supported on this platform.
+func Free(path string) (uint64, error) { return 0, errors.ErrUnsupported }
+
+// Inode is not supported on this platform, and always returns zero.
+func Inode(fi os.FileInfo) uint64 { return 0 }
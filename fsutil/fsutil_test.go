@@ -0,0 +1,296 @@
+package fsutil
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, data string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPublish(t *testing.T) {
+	dst := t.TempDir()
+	src, err := StagingDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dst, "existing", "a"), "old a")
+	writeFile(t, filepath.Join(dst, "existing", "b"), "old b")
+	writeFile(t, filepath.Join(src, "existing", "a"), "new a")
+	writeFile(t, filepath.Join(src, "new", "c"), "new c")
+	writeFile(t, filepath.Join(src, "d"), "new d")
+
+	moved, err := Publish(src, dst, OverwriteAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 0 {
+		t.Errorf("want no moved files, got %v", moved)
+	}
+	var tests = []struct {
+		name string
+		data string
+	}{
+		{filepath.Join("existing", "a"), "new a"},
+		{filepath.Join("existing", "b"), "old b"},
+		{filepath.Join("new", "c"), "new c"},
+		{"d", "new d"},
+	}
+	for _, tt := range tests {
+		if got := readFile(t, filepath.Join(dst, tt.name)); got != tt.data {
+			t.Errorf("want %q, got %q for %s", tt.data, got, tt.name)
+		}
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("want %s to be removed", src)
+	}
+}
+
+func TestPublishConflict(t *testing.T) {
+	var tests = []struct {
+		policy string
+		data   string
+		moved  map[string]string
+		err    string
+	}{
+		{OverwriteAlways, "new", map[string]string{}, ""},
+		{OverwriteNever, "old", map[string]string{"dir/a": ""}, ""},
+		{OverwriteIfNewer, "old", map[string]string{"dir/a": ""}, ""},
+		{OverwriteRename, "old", map[string]string{"dir/a": "dir/a.1"}, ""},
+		{OverwriteFail, "old", nil, "file exists: "},
+	}
+	for i, tt := range tests {
+		dst := t.TempDir()
+		src, err := StagingDir(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The staged file is older than the file that appeared in dst after it was staged
+		name := filepath.Join(src, "dir", "a")
+		writeFile(t, name, "new")
+		past := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(name, past, past); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dst, "dir", "a"), "old")
+
+		moved, err := Publish(src, dst, tt.policy)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+			}
+		} else if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if !reflect.DeepEqual(tt.moved, moved) {
+			t.Errorf("#%d: want moved %v, got %v", i, tt.moved, moved)
+		}
+		if got := readFile(t, filepath.Join(dst, "dir", "a")); got != tt.data {
+			t.Errorf("#%d: want %q, got %q", i, tt.data, got)
+		}
+		if tt.policy == OverwriteRename {
+			if got := readFile(t, filepath.Join(dst, "dir", "a.1")); got != "new" {
+				t.Errorf("#%d: want renamed file to be published, got %q", i, got)
+			}
+		}
+	}
+}
+
+func TestRenameExclusive(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	writeFile(t, a, "a")
+	writeFile(t, b, "b")
+	if err := renameExclusive(a, b); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("want %s, got %v", fs.ErrExist, err)
+	}
+	if got := readFile(t, b); got != "b" {
+		t.Errorf("want existing file to be kept, got %q", got)
+	}
+	c := filepath.Join(dir, "c")
+	if err := renameExclusive(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("want %s to be removed", a)
+	}
+	if got := readFile(t, c); got != "a" {
+		t.Errorf("want %q, got %q", "a", got)
+	}
+}
+
+func TestRemoveStaging(t *testing.T) {
+	root := t.TempDir()
+	staging1, err := StagingDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "foo", "bar"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	staging2, err := StagingDir(filepath.Join(root, "foo", "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(staging2, "partial"), "")
+	writeFile(t, filepath.Join(root, "foo", "keep"), "")
+
+	removed, err := RemoveStaging(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(removed); want != got {
+		t.Errorf("want %d removed directories, got %d", want, got)
+	}
+	for _, dir := range []string{staging1, staging2} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed", dir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "foo", "keep")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInStaging(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out bool
+	}{
+		{"/foo/bar.rar", false},
+		{"/foo/.unp-staging-123/bar.rar", true},
+		{"/foo/.unp-staging-123", true},
+		{"/foo/unp-staging-123/bar.rar", false},
+	}
+	for _, tt := range tests {
+		if got := InStaging(tt.in); got != tt.out {
+			t.Errorf("want %t, got %t for %s", tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "foo.mkv")
+	writeFile(t, existing, "")
+	writeFile(t, filepath.Join(dir, "foo.1.mkv"), "")
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(existing, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "bar.mkv")
+	var tests = []struct {
+		policy string
+		name   string
+		mtime  time.Time
+		out    string
+		err    string
+	}{
+		{"", existing, mtime, existing, ""},
+		{OverwriteAlways, existing, mtime, existing, ""},
+		{OverwriteNever, existing, mtime, "", ""},
+		{OverwriteNever, missing, mtime, missing, ""},
+		{OverwriteIfNewer, existing, mtime, "", ""},
+		{OverwriteIfNewer, existing, mtime.Add(-time.Hour), "", ""},
+		{OverwriteIfNewer, existing, mtime.Add(time.Hour), existing, ""},
+		{OverwriteRename, existing, mtime, filepath.Join(dir, "foo.2.mkv"), ""},
+		{OverwriteRename, missing, mtime, missing, ""},
+		{OverwriteFail, existing, mtime, "", "file exists: " + existing},
+		{OverwriteFail, missing, mtime, missing, ""},
+		{"bogus", existing, mtime, "", `invalid overwrite policy: "bogus"`},
+	}
+	for i, tt := range tests {
+		got, err := ResolveConflict(tt.policy, tt.name, tt.mtime)
+		if err != nil && err.Error() != tt.err {
+			t.Errorf("#%d: want error %q, got %q", i, tt.err, err)
+		} else if err == nil && tt.err != "" {
+			t.Errorf("#%d: want error %q", i, tt.err)
+		}
+		if got != tt.out {
+			t.Errorf("#%d: want %q, got %q", i, tt.out, got)
+		}
+	}
+}
+
+func TestContainsSymlink(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b", filepath.Join(root, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		out bool
+	}{
+		{"foo", false},
+		{"link", false},
+		{filepath.Join("a", "link"), false},
+		{filepath.Join("a", "b", "foo"), false},
+		{filepath.Join("a", "link", "foo"), true},
+		{filepath.Join("a", "link", "c", "foo"), true},
+		{filepath.Join("a", "missing", "foo"), false},
+	}
+	for _, tt := range tests {
+		got, err := ContainsSymlink(root, filepath.Join(root, tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.out {
+			t.Errorf("want %t, got %t for %s", tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := Free(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSpace(dir, 1, 0); err != nil {
+		t.Errorf("want no error, got %s", err)
+	}
+	if err := CheckSpace(dir, int64(free/2), int64(free)); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("want %s, got %v", ErrInsufficientSpace, err)
+	}
+}
+
+func TestCheckSettled(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "foo")
+	writeFile(t, name, "foo")
+	names := []string{name, filepath.Join(dir, "missing")}
+	if err := CheckSettled(names, time.Hour); !errors.Is(err, ErrChanging) {
+		t.Errorf("want %s, got %v", ErrChanging, err)
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(name, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSettled(names, time.Hour); err != nil {
+		t.Errorf("want no error, got %s", err)
+	}
+}
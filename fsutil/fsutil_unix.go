@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd
+
+package fsutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// Free returns the number of bytes available to unprivileged users on the file system holding path.
+func Free(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// Inode returns the inode number of the file described by fi, or zero if unknown.
+func Inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package fsutil
+
+// renameNoReplace renames from to to, failing with an error wrapping fs.ErrExist if to exists.
+func renameNoReplace(from, to string) error { return renameExclusive(from, to) }
@@ -3,10 +3,23 @@ module github.com/mpolden/unp
 go 1.21
 
 require (
+	github.com/bodgit/sevenzip v1.6.1
+	github.com/klauspost/compress v1.17.11
 	github.com/mattn/go-isatty v0.0.22
 	github.com/mpolden/sfv v0.9.0
-	github.com/nwaples/rardecode/v2 v2.2.2
+	github.com/nwaples/rardecode/v2 v2.4.1
 	github.com/rjeczalik/notify v0.9.3
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/sys v0.28.0
 )
 
-require golang.org/x/sys v0.28.0 // indirect
+require (
+	github.com/andybalholm/brotli v1.1.1 // indirect
+	github.com/bodgit/plumbing v1.3.0 // indirect
+	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/pierrec/lz4/v4 v4.1.22 // indirect
+	github.com/spf13/afero v1.11.0 // indirect
+	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
@@ -0,0 +1,164 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mpolden/unp/fsutil"
+)
+
+// Filename is the name of the file, in the destination directory, listing the sets unpacked to that directory.
+const Filename = ".unp-manifest.json"
+
+// mu serializes access to manifests, which may be shared by handlers unpacking to the same directory.
+var mu sync.Mutex
+
+// Manifest records the sets unpacked to a directory, keyed by the name of the set.
+type Manifest struct {
+	Sets map[string]Set `json:"sets"`
+}
+
+// Set records the source volumes of a set, and the files unpacked from it.
+type Set struct {
+	Volumes []Volume `json:"volumes"`
+	Files   []Entry  `json:"files"`
+}
+
+type Volume struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// Entry is a file unpacked from a set. Name is slash-separated and relative to the destination directory.
+type Entry struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 string `json:"crc32"`
+}
+
+// Read reads the manifest in dir. A missing manifest is read as an empty one.
+func Read(dir string) (*Manifest, error) {
+	m := &Manifest{Sets: make(map[string]Set)}
+	data, err := os.ReadFile(filepath.Join(dir, Filename))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Sets == nil {
+		m.Sets = make(map[string]Set)
+	}
+	return m, nil
+}
+
+// Write writes m to dir.
+func (m *Manifest) Write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFile(filepath.Join(dir, Filename), data, 0644)
+}
+
+func statVolume(name string) (Volume, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return Volume{}, err
+	}
+	return Volume{Path: name, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}, nil
+}
+
+// NewSet creates a set of the current state of volumes, and the files unpacked from them.
+func NewSet(volumes []string, files []Entry) (Set, error) {
+	s := Set{Files: files}
+	for _, v := range volumes {
+		mv, err := statVolume(v)
+		if err != nil {
+			return Set{}, err
+		}
+		s.Volumes = append(s.Volumes, mv)
+	}
+	return s, nil
+}
+
+// Matches returns whether none of the volumes in s have changed, and all files unpacked from s still exist in dir
+// with their original size.
+func (s Set) Matches(dir string) bool {
+	for _, v := range s.Volumes {
+		cur, err := statVolume(v.Path)
+		if err != nil || cur != v {
+			return false
+		}
+	}
+	for _, f := range s.Files {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.Name)))
+		if err != nil || fi.Size() != f.Size {
+			return false
+		}
+	}
+	return true
+}
+
+type forceKey struct{}
+
+// WithForce returns a copy of ctx where sets are unpacked again, even if the manifest shows that they have already
+// been unpacked.
+func WithForce(ctx context.Context) context.Context { return context.WithValue(ctx, forceKey{}, true) }
+
+// Unpacked returns whether the manifest in dir shows that the set name has already been unpacked, and neither its
+// volumes nor its unpacked files have changed since. This is always false if ctx was created by WithForce.
+func Unpacked(ctx context.Context, dir, name string) bool {
+	if force, _ := ctx.Value(forceKey{}).(bool); force {
+		return false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	m, err := Read(dir)
+	if err != nil {
+		return false
+	}
+	s, ok := m.Sets[name]
+	return ok && s.Matches(dir)
+}
+
+// Contains returns whether the manifest in dir has a set with the given volume, and the set has not changed since it
+// was recorded.
+func Contains(dir, volume string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	m, err := Read(dir)
+	if err != nil {
+		return false
+	}
+	for _, s := range m.Sets {
+		for _, v := range s.Volumes {
+			if v.Path == volume && s.Matches(dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Record adds the set name, with its volumes and the files unpacked from it, to the manifest in dir.
+func Record(dir, name string, volumes []string, files []Entry) error {
+	mu.Lock()
+	defer mu.Unlock()
+	m, err := Read(dir)
+	if err != nil {
+		return err
+	}
+	s, err := NewSet(volumes, files)
+	if err != nil {
+		return err
+	}
+	m.Sets[name] = s
+	return m.Write(dir)
+}
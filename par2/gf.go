@@ -0,0 +1,123 @@
+package par2
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PAR2 computes recovery data in the Galois field GF(2^16), using the generator polynomial x^16 + x^12 + x^3 + x + 1.
+const (
+	gfPoly  = 0x1100b
+	gfOrder = 1<<16 - 1
+)
+
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [2 * gfOrder]uint16, log [1 << 16]uint16) {
+	x := 1
+	for i := 0; i < gfOrder; i++ {
+		exp[i] = uint16(x)
+		exp[i+gfOrder] = uint16(x)
+		log[x] = uint16(i)
+		x <<= 1
+		if x&(1<<16) != 0 {
+			x ^= gfPoly
+		}
+	}
+	return exp, log
+}
+
+func gfMul(a, b uint16) uint16 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b uint16) uint16 {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+gfOrder-int(gfLog[b])]
+}
+
+// gfPow returns a raised to the power of n.
+func gfPow(a uint16, n uint32) uint16 {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[uint64(gfLog[a])*uint64(n)%gfOrder]
+}
+
+// inputConstants returns the constants that the first n input slices are multiplied by when computing recovery data.
+// The constants are the powers of two whose exponent is coprime with the order of the field.
+func inputConstants(n int) []uint16 {
+	constants := make([]uint16, 0, n)
+	for e := 0; len(constants) < n; e++ {
+		if e%3 != 0 && e%5 != 0 && e%17 != 0 && e%257 != 0 {
+			constants = append(constants, gfExp[e])
+		}
+	}
+	return constants
+}
+
+// mulAdd adds src multiplied by factor to dst. Both are sequences of little-endian 16-bit words of the same length.
+func mulAdd(dst, src []byte, factor uint16) {
+	if factor == 0 {
+		return
+	}
+	for i := 0; i+1 < len(src); i += 2 {
+		w := binary.LittleEndian.Uint16(src[i:])
+		if w == 0 {
+			continue
+		}
+		p := gfExp[int(gfLog[w])+int(gfLog[factor])]
+		binary.LittleEndian.PutUint16(dst[i:], binary.LittleEndian.Uint16(dst[i:])^p)
+	}
+}
+
+// invert returns the inverse of the square matrix m, using Gauss-Jordan elimination.
+func invert(m [][]uint16) ([][]uint16, error) {
+	n := len(m)
+	a := make([][]uint16, n)
+	inv := make([][]uint16, n)
+	for i := range m {
+		a[i] = append([]uint16(nil), m[i]...)
+		inv[i] = make([]uint16, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if a[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular matrix")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if f := a[col][col]; f != 1 {
+			for j := 0; j < n; j++ {
+				a[col][j] = gfDiv(a[col][j], f)
+				inv[col][j] = gfDiv(inv[col][j], f)
+			}
+		}
+		for row := 0; row < n; row++ {
+			f := a[row][col]
+			if row == col || f == 0 {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				a[row][j] ^= gfMul(f, a[col][j])
+				inv[row][j] ^= gfMul(f, inv[col][j])
+			}
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,74 @@
+package par2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInputConstants(t *testing.T) {
+	want := []uint16{2, 4, 16, 128, 256, 2048, 8192, 16384, 4107, 32856}
+	got := inputConstants(len(want))
+	for i := range want {
+		if want[i] != got[i] {
+			t.Errorf("#%d: want %d, got %d", i, want[i], got[i])
+		}
+	}
+}
+
+func TestGF(t *testing.T) {
+	for _, a := range []uint16{1, 2, 3, 0x100b, 0x8000, 0xffff} {
+		for _, b := range []uint16{1, 2, 7, 0x1234, 0xffff} {
+			if got := gfDiv(gfMul(a, b), b); got != a {
+				t.Errorf("want (%d * %d) / %d = %d, got %d", a, b, b, a, got)
+			}
+		}
+	}
+	if want, got := uint16(0x100b), gfMul(2, 0x8000); want != got {
+		t.Errorf("want %#x, got %#x", want, got)
+	}
+	if want, got := gfMul(gfMul(7, 7), 7), gfPow(7, 3); want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
+
+func TestMulAdd(t *testing.T) {
+	// Multiplying by one is addition, which is XOR in GF(2^16)
+	dst := []byte{0x0f, 0xf0, 0xaa, 0x55}
+	mulAdd(dst, []byte{0xff, 0xff, 0x00, 0x55}, 1)
+	if want := []byte{0xf0, 0x0f, 0xaa, 0x00}; !bytes.Equal(want, dst) {
+		t.Errorf("want %x, got %x", want, dst)
+	}
+}
+
+func TestInvert(t *testing.T) {
+	constants := inputConstants(4)
+	m := make([][]uint16, len(constants))
+	for i := range m {
+		m[i] = make([]uint16, len(constants))
+		for j, c := range constants {
+			m[i][j] = gfPow(c, uint32(i))
+		}
+	}
+	inv, err := invert(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m {
+		for j := range m {
+			var sum uint16
+			for k := range m {
+				sum ^= gfMul(inv[i][k], m[k][j])
+			}
+			want := uint16(0)
+			if i == j {
+				want = 1
+			}
+			if sum != want {
+				t.Errorf("want identity matrix, got %d at (%d, %d)", sum, i, j)
+			}
+		}
+	}
+	if _, err := invert([][]uint16{{1, 1}, {1, 1}}); err == nil {
+		t.Error("want error for singular matrix")
+	}
+}
@@ -0,0 +1,223 @@
+package par2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	headerSize = 64
+	// maxSliceSize is the largest slice size accepted, far larger than what PAR2 clients choose. Slices are read into
+	// memory whole, so a damaged or malicious main packet must not be able to request arbitrarily large buffers.
+	maxSliceSize = 1 << 30
+)
+
+var (
+	magic = [8]byte{'P', 'A', 'R', '2', 0, 'P', 'K', 'T'}
+
+	typeMain     = packetType("PAR 2.0\x00Main\x00\x00\x00\x00")
+	typeFileDesc = packetType("PAR 2.0\x00FileDesc")
+	typeIFSC     = packetType("PAR 2.0\x00IFSC\x00\x00\x00\x00")
+	typeRecovery = packetType("PAR 2.0\x00RecvSlic")
+)
+
+func packetType(s string) (t [16]byte) {
+	copy(t[:], s)
+	return t
+}
+
+// header is the header common to all packets.
+type header struct {
+	Magic  [8]byte
+	Length uint64
+	Hash   [16]byte
+	SetID  [16]byte
+	Type   [16]byte
+}
+
+// packet is a packet read from a PAR2 file. The body of recovery slice packets is not read, as it is as large as a
+// slice. Instead, the location of the body is recorded so that it can be read when needed.
+type packet struct {
+	header
+	body   []byte
+	file   string
+	offset int64
+	// exponent is the exponent of a recovery slice packet.
+	exponent uint32
+}
+
+// verify returns whether the hash in the header of p matches the packet contents. For recovery slice packets, the
+// body is read from file.
+func (p *packet) verify() (bool, error) {
+	h := md5.New()
+	h.Write(p.SetID[:])
+	h.Write(p.Type[:])
+	if p.body != nil {
+		h.Write(p.body)
+	} else {
+		f, err := os.Open(p.file)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, io.NewSectionReader(f, p.offset, int64(p.Length)-headerSize)); err != nil {
+			return false, err
+		}
+	}
+	return bytes.Equal(h.Sum(nil), p.Hash[:]), nil
+}
+
+// readPackets reads the packets in the PAR2 file name. Damaged packets are skipped, by searching for the next packet
+// header.
+func readPackets(name string) ([]*packet, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var packets []*packet
+	r := bufio.NewReader(f)
+	var offset int64
+	// seek continues reading at off, without reading the bytes in between
+	seek := func(off int64) error {
+		offset = off
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		r.Reset(f)
+		return nil
+	}
+	for offset+headerSize <= fi.Size() {
+		buf, err := r.Peek(headerSize)
+		if err != nil {
+			return nil, err
+		}
+		var h header
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+			return nil, err
+		}
+		// Length is compared unsigned, as it may not fit in an int64
+		if h.Magic != magic || h.Length < headerSize || h.Length%4 != 0 || h.Length > uint64(fi.Size()-offset) {
+			// Not a valid header, continue searching from the next aligned position
+			if _, err := r.Discard(4); err != nil {
+				return nil, err
+			}
+			offset += 4
+			continue
+		}
+		p := &packet{header: h, file: name, offset: offset + headerSize}
+		if h.Type == typeRecovery {
+			// The recovery slice is only read when repairing, so only its exponent is read here
+			if h.Length >= headerSize+4 {
+				b, err := r.Peek(headerSize + 4)
+				if err != nil {
+					return nil, err
+				}
+				p.exponent = binary.LittleEndian.Uint32(b[headerSize:])
+				packets = append(packets, p)
+			}
+			if err := seek(offset + int64(h.Length)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, err := r.Discard(headerSize); err != nil {
+			return nil, err
+		}
+		p.body = make([]byte, int(h.Length)-headerSize)
+		if _, err := io.ReadFull(r, p.body); err != nil {
+			return nil, err
+		}
+		if ok, _ := p.verify(); !ok {
+			// Packet is damaged. It may have hidden the start of another packet, so search inside it
+			if err := seek(offset + 4); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		packets = append(packets, p)
+		offset += int64(h.Length)
+	}
+	return packets, nil
+}
+
+// mainPacket is the body of a main packet.
+type mainPacket struct {
+	sliceSize int64
+	fileIDs   [][16]byte
+}
+
+func parseMain(b []byte) (mainPacket, error) {
+	if len(b) < 12 {
+		return mainPacket{}, errors.New("main packet too short")
+	}
+	m := mainPacket{sliceSize: int64(binary.LittleEndian.Uint64(b))}
+	n := int(binary.LittleEndian.Uint32(b[8:]))
+	if m.sliceSize <= 0 || m.sliceSize%4 != 0 || m.sliceSize > maxSliceSize {
+		return mainPacket{}, fmt.Errorf("invalid slice size: %d", m.sliceSize)
+	}
+	if len(b) < 12+16*n {
+		return mainPacket{}, errors.New("main packet too short")
+	}
+	for i := 0; i < n; i++ {
+		var id [16]byte
+		copy(id[:], b[12+16*i:])
+		m.fileIDs = append(m.fileIDs, id)
+	}
+	return m, nil
+}
+
+// fileDesc is the body of a file description packet.
+type fileDesc struct {
+	id   [16]byte
+	hash [16]byte
+	size int64
+	name string
+}
+
+func parseFileDesc(b []byte) (fileDesc, error) {
+	if len(b) < 56 {
+		return fileDesc{}, errors.New("file description packet too short")
+	}
+	var d fileDesc
+	copy(d.id[:], b)
+	copy(d.hash[:], b[16:])
+	d.size = int64(binary.LittleEndian.Uint64(b[48:]))
+	if d.size < 0 {
+		return fileDesc{}, fmt.Errorf("invalid file size: %d", uint64(d.size))
+	}
+	d.name = string(bytes.TrimRight(b[56:], "\x00"))
+	return d, nil
+}
+
+// sliceChecksum is the checksum of an input slice, as stored in input file slice checksum packets.
+type sliceChecksum struct {
+	hash  [16]byte
+	crc32 uint32
+}
+
+func parseIFSC(b []byte) ([16]byte, []sliceChecksum, error) {
+	var id [16]byte
+	if len(b) < 16 || (len(b)-16)%20 != 0 {
+		return id, nil, errors.New("invalid input file slice checksum packet")
+	}
+	copy(id[:], b)
+	var checksums []sliceChecksum
+	for i := 16; i < len(b); i += 20 {
+		var c sliceChecksum
+		copy(c.hash[:], b[i:])
+		c.crc32 = binary.LittleEndian.Uint32(b[i+16:])
+		checksums = append(checksums, c)
+	}
+	return id, checksums, nil
+}
@@ -0,0 +1,674 @@
+package par2
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/pathutil"
+	"github.com/mpolden/unp/syncutil"
+)
+
+// ErrNotFound is returned when no PAR2 set describes a file.
+var ErrNotFound = errors.New("no par2 set found")
+
+// ErrNotReady is returned when a set cannot be repaired yet, because its recovery volumes are incomplete or its files
+// are still changing.
+var ErrNotReady = errors.New("not ready for repair")
+
+// volumeRE matches recovery volumes, such as foo.vol00+01.par2, capturing the first exponent and the number of recovery
+// slices in the volume.
+var volumeRE = regexp.MustCompile(`(?i)\.vol(\d+)[+-](\d+)\.par2$`)
+
+func isPar2(name string) bool { return strings.EqualFold(filepath.Ext(name), ".par2") }
+
+// file is a file protected by a PAR2 set.
+type file struct {
+	fileDesc
+	path      string
+	checksums []sliceChecksum
+	// first is the index of the first slice of this file among all input slices of the set.
+	first int
+}
+
+// slices returns the number of slices in f, given the slice size.
+func (f *file) slices(sliceSize int64) int { return int((f.size + sliceSize - 1) / sliceSize) }
+
+// Set is a set of PAR2 files, describing the files it protects and the recovery slices available to repair them.
+type Set struct {
+	// Name is the path of the index file of the set, i.e. the PAR2 file that is not a recovery volume.
+	Name string
+	// Files are the paths of the PAR2 files of the set.
+	Files     []string
+	id        [16]byte
+	sliceSize int64
+	files     []*file
+	// recovery holds the recovery slice packets of the set, keyed by exponent.
+	recovery map[uint32]*packet
+}
+
+// Report describes the state of a PAR2 set, as found by Repair.
+type Report struct {
+	// Blocks is the number of input slices in the set.
+	Blocks int
+	// Damaged is the number of input slices that were damaged or missing.
+	Damaged int
+	// Recovery is the number of recovery slices available.
+	Recovery int
+	// Repaired is true if the damaged slices were repaired.
+	Repaired bool
+}
+
+// OK returns whether the set is intact, either because nothing was damaged or because it was repaired.
+func (r Report) OK() bool { return r.Damaged == 0 || r.Repaired }
+
+func (r Report) String() string {
+	switch {
+	case r.Damaged == 0:
+		return fmt.Sprintf("%d/%d blocks damaged", r.Damaged, r.Blocks)
+	case r.Repaired:
+		return fmt.Sprintf("%d/%d blocks damaged, repaired using %d recovery blocks", r.Damaged, r.Blocks, r.Damaged)
+	}
+	return fmt.Sprintf("%d/%d blocks damaged, not repairable with %d recovery blocks", r.Damaged, r.Blocks, r.Recovery)
+}
+
+// Key returns a key identifying the set.
+func (s *Set) Key() string { return filepath.Join(filepath.Dir(s.Name), hex.EncodeToString(s.id[:])) }
+
+// Paths returns the paths of the files protected by the set.
+func (s *Set) Paths() []string {
+	paths := make([]string, 0, len(s.files))
+	for _, f := range s.files {
+		paths = append(paths, f.path)
+	}
+	return paths
+}
+
+// Cache holds the packets read from PAR2 files, so that a file is only read again when it changes.
+type Cache struct {
+	mu    sync.Mutex
+	files map[string]cachedFile
+}
+
+type cachedFile struct {
+	size    int64
+	modTime time.Time
+	packets []*packet
+}
+
+func NewCache() *Cache { return &Cache{files: make(map[string]cachedFile)} }
+
+// readPackets reads the packets in the PAR2 file name, unless they are cached and name has not changed since.
+func (c *Cache) readPackets(name string) ([]*packet, error) {
+	if c == nil {
+		return readPackets(name)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	cf, ok := c.files[name]
+	c.mu.Unlock()
+	if ok && cf.size == fi.Size() && cf.modTime.Equal(fi.ModTime()) {
+		return cf.packets, nil
+	}
+	packets, err := readPackets(name)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.files[name] = cachedFile{size: fi.Size(), modTime: fi.ModTime(), packets: packets}
+	c.mu.Unlock()
+	return packets, nil
+}
+
+// prune forgets the cached files in dir that are not listed in names.
+func (c *Cache) prune(dir string, names []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.files {
+		if filepath.Dir(name) == dir && !contains(names, name) {
+			delete(c.files, name)
+		}
+	}
+}
+
+// Forget forgets the cached packets of the PAR2 files of s.
+func (c *Cache) Forget(s *Set) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range s.Files {
+		delete(c.files, name)
+	}
+}
+
+// Find returns the PAR2 set that filename belongs to. Filename is either one of the PAR2 files of the set, or a file
+// protected by it. PAR2 files are read from the directory of filename.
+func Find(filename string) (*Set, error) { return (*Cache)(nil).Find(filename) }
+
+// Find works like the package-level Find, but reads packets through c.
+func (c *Cache) Find(filename string) (*Set, error) {
+	dir := filepath.Dir(filename)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	packets := make(map[[16]byte][]*packet)
+	files := make(map[[16]byte][]string)
+	for _, e := range entries {
+		if e.IsDir() || !isPar2(e.Name()) {
+			continue
+		}
+		name := filepath.Join(dir, e.Name())
+		names = append(names, name)
+		ps, err := c.readPackets(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ps {
+			if !contains(files[p.SetID], name) {
+				files[p.SetID] = append(files[p.SetID], name)
+			}
+			packets[p.SetID] = append(packets[p.SetID], p)
+		}
+	}
+	c.prune(dir, names)
+	// Sets are considered in a stable order, so that the same set is found for the same file
+	ids := make([][16]byte, 0, len(packets))
+	for id := range packets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	for _, id := range ids {
+		if isPar2(filename) && !contains(files[id], filename) {
+			continue
+		}
+		s, err := newSet(dir, id, files[id], packets[id])
+		if err != nil {
+			return nil, err
+		}
+		if isPar2(filename) || contains(s.Paths(), filename) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNotFound, filename)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newSet creates the set identified by id from its packets.
+func newSet(dir string, id [16]byte, names []string, packets []*packet) (*Set, error) {
+	sort.Strings(names)
+	s := &Set{Name: names[0], Files: names, id: id, recovery: make(map[uint32]*packet)}
+	for _, name := range names {
+		if !volumeRE.MatchString(name) {
+			s.Name = name
+			break
+		}
+	}
+	var main *mainPacket
+	descs := make(map[[16]byte]fileDesc)
+	checksums := make(map[[16]byte][]sliceChecksum)
+	for _, p := range packets {
+		switch p.Type {
+		case typeMain:
+			m, err := parseMain(p.body)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p.file, err)
+			}
+			main = &m
+		case typeFileDesc:
+			d, err := parseFileDesc(p.body)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p.file, err)
+			}
+			descs[d.id] = d
+		case typeIFSC:
+			fileID, cs, err := parseIFSC(p.body)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p.file, err)
+			}
+			checksums[fileID] = cs
+		case typeRecovery:
+			s.recovery[p.exponent] = p
+		}
+	}
+	if main == nil {
+		return nil, fmt.Errorf("%s: no main packet found", s.Name)
+	}
+	s.sliceSize = main.sliceSize
+	first := 0
+	var total int64
+	for _, fileID := range main.fileIDs {
+		d, ok := descs[fileID]
+		if !ok {
+			return nil, fmt.Errorf("%s: no description found for file %x", s.Name, fileID)
+		}
+		path, err := pathutil.Join(dir, d.name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: unsafe file name: %w", s.Name, err)
+		}
+		f := &file{fileDesc: d, path: path, checksums: checksums[fileID], first: first}
+		if n := f.slices(s.sliceSize); len(f.checksums) != n {
+			return nil, fmt.Errorf("%s: want %d slice checksums for %s, got %d", s.Name, n, d.name, len(f.checksums))
+		}
+		first += len(f.checksums)
+		total += d.size
+		s.files = append(s.files, f)
+	}
+	// A slice is never larger than the files it protects, except for padding
+	if s.sliceSize > total+3 {
+		return nil, fmt.Errorf("%s: slice size %d exceeds size of protected files", s.Name, s.sliceSize)
+	}
+	return s, nil
+}
+
+// readSlice reads slice i of r into buf, padding it with zeroes if r ends early. The number of bytes read is
+// returned.
+func (s *Set) readSlice(r io.ReaderAt, i int, buf []byte) (int, error) {
+	n, err := r.ReadAt(buf, int64(i)*s.sliceSize)
+	if err == io.EOF {
+		err = nil
+	}
+	for j := n; j < len(buf); j++ {
+		buf[j] = 0
+	}
+	return n, err
+}
+
+// verifyFile returns the indices of the slices of f that are damaged or missing, and whether f has exactly the
+// expected contents.
+func (s *Set) verifyFile(ctx context.Context, f *file) ([]int, bool, error) {
+	var damaged []int
+	r, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		for i := range f.checksums {
+			damaged = append(damaged, i)
+		}
+		return damaged, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	buf := make([]byte, s.sliceSize)
+	for i, c := range f.checksums {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		n, err := s.readSlice(r, i, buf)
+		if err != nil {
+			return nil, false, err
+		}
+		want := f.size - int64(i)*s.sliceSize
+		if want > s.sliceSize {
+			want = s.sliceSize
+		}
+		// Data beyond the expected end of the file is not part of the slice
+		for j := want; j < int64(n); j++ {
+			buf[j] = 0
+		}
+		hash := md5.Sum(buf)
+		if int64(n) < want || hash != c.hash || crc32.ChecksumIEEE(buf) != c.crc32 {
+			damaged = append(damaged, i)
+		}
+	}
+	return damaged, len(damaged) == 0 && fi.Size() == f.size, nil
+}
+
+// damage describes the damaged files of a set, and the indices of their damaged slices among all input slices.
+type damage struct {
+	files  []*file
+	slices []int
+}
+
+func (s *Set) verify(ctx context.Context) (damage, int, error) {
+	var d damage
+	blocks := 0
+	for _, f := range s.files {
+		slices, intact, err := s.verifyFile(ctx, f)
+		if err != nil {
+			return damage{}, 0, err
+		}
+		if !intact {
+			d.files = append(d.files, f)
+		}
+		for _, i := range slices {
+			d.slices = append(d.slices, f.first+i)
+		}
+		blocks += len(f.checksums)
+	}
+	return d, blocks, nil
+}
+
+// recoverySlices returns n recovery slices whose packets are intact, and their exponents.
+func (s *Set) recoverySlices(n int) ([][]byte, []uint32, error) {
+	exponents := make([]uint32, 0, len(s.recovery))
+	for e := range s.recovery {
+		exponents = append(exponents, e)
+	}
+	sort.Slice(exponents, func(i, j int) bool { return exponents[i] < exponents[j] })
+	var slices [][]byte
+	var used []uint32
+	for _, e := range exponents {
+		if len(slices) == n {
+			break
+		}
+		p := s.recovery[e]
+		if int64(p.Length)-headerSize-4 != s.sliceSize {
+			continue
+		}
+		if ok, err := p.verify(); err != nil {
+			return nil, nil, err
+		} else if !ok {
+			continue
+		}
+		f, err := os.Open(p.file)
+		if err != nil {
+			return nil, nil, err
+		}
+		data := make([]byte, s.sliceSize)
+		_, err = f.ReadAt(data, p.offset+4)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		slices = append(slices, data)
+		used = append(used, e)
+	}
+	if len(slices) < n {
+		return nil, nil, fmt.Errorf("need %d intact recovery blocks, got %d", n, len(slices))
+	}
+	return slices, used, nil
+}
+
+// reconstruct computes the contents of the damaged input slices in d, from the intact input slices and recovery
+// slices. The reconstructed slices are returned keyed by their index among all input slices.
+func (s *Set) reconstruct(ctx context.Context, d damage) (map[int][]byte, error) {
+	recovery, exponents, err := s.recoverySlices(len(d.slices))
+	if err != nil {
+		return nil, err
+	}
+	blocks := 0
+	for _, f := range s.files {
+		blocks += len(f.checksums)
+	}
+	constants := inputConstants(blocks)
+	// Each recovery slice is the sum of all input slices multiplied by their constant raised to the exponent of the
+	// recovery slice. Subtracting the intact input slices leaves a linear system in the damaged ones
+	damaged := make(map[int]bool, len(d.slices))
+	for _, i := range d.slices {
+		damaged[i] = true
+	}
+	buf := make([]byte, s.sliceSize)
+	for _, f := range s.files {
+		r, err := os.Open(f.path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for i := range f.checksums {
+			if damaged[f.first+i] {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				r.Close()
+				return nil, err
+			}
+			if _, err := s.readSlice(r, i, buf); err != nil {
+				r.Close()
+				return nil, err
+			}
+			for j, e := range exponents {
+				mulAdd(recovery[j], buf, gfPow(constants[f.first+i], e))
+			}
+		}
+		r.Close()
+	}
+	m := make([][]uint16, len(exponents))
+	for j, e := range exponents {
+		m[j] = make([]uint16, len(d.slices))
+		for k, i := range d.slices {
+			m[j][k] = gfPow(constants[i], e)
+		}
+	}
+	inv, err := invert(m)
+	if err != nil {
+		return nil, err
+	}
+	slices := make(map[int][]byte, len(d.slices))
+	for k, i := range d.slices {
+		data := make([]byte, s.sliceSize)
+		for j := range recovery {
+			mulAdd(data, recovery[j], inv[k][j])
+		}
+		slices[i] = data
+	}
+	return slices, nil
+}
+
+// rewrite writes f using its intact slices and the reconstructed slices, and replaces f if the result has the
+// expected contents.
+func (s *Set) rewrite(f *file, slices map[int][]byte) error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".unp-par2-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var r *os.File
+	if r, err = os.Open(f.path); err == nil {
+		defer r.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	hash := md5.New()
+	w := io.MultiWriter(tmp, hash)
+	buf := make([]byte, s.sliceSize)
+	for i := range f.checksums {
+		data, ok := slices[f.first+i]
+		if !ok {
+			if _, err := s.readSlice(r, i, buf); err != nil {
+				return err
+			}
+			data = buf
+		}
+		n := f.size - int64(i)*s.sliceSize
+		if n > s.sliceSize {
+			n = s.sliceSize
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(hash.Sum(nil), f.hash[:]) {
+		return fmt.Errorf("checksum mismatch after repair: %s", f.name)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// checkVolumes returns an error if any recovery volume of s lacks some of the recovery slices its name declares, or if
+// the volumes leave a gap in the exponents of the recovery slices, which means that a volume is missing.
+func (s *Set) checkVolumes() error {
+	type volume struct {
+		name         string
+		first, count uint32
+	}
+	var volumes []volume
+	for _, name := range s.Files {
+		m := volumeRE.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		first, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil {
+			return err
+		}
+		count, err := strconv.ParseUint(m[2], 10, 32)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, volume{name: name, first: uint32(first), count: uint32(count)})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].first < volumes[j].first })
+	var next uint32
+	for _, v := range volumes {
+		if v.first > next {
+			return fmt.Errorf("missing recovery volume for blocks %d-%d", next, v.first-1)
+		}
+		for e := v.first; e < v.first+v.count; e++ {
+			if p, ok := s.recovery[e]; !ok || p.file != v.name {
+				return fmt.Errorf("incomplete recovery volume: %s", filepath.Base(v.name))
+			}
+		}
+		if end := v.first + v.count; end > next {
+			next = end
+		}
+	}
+	return nil
+}
+
+// ready returns an error wrapping ErrNotReady if s should not be repaired yet, because a recovery volume is missing
+// or incomplete, or because any file of s was modified within delay.
+func (s *Set) ready(delay time.Duration) error {
+	if err := s.checkVolumes(); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotReady, err)
+	}
+	if err := fsutil.CheckSettled(append(s.Paths(), s.Files...), delay); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotReady, err)
+	}
+	return nil
+}
+
+// Repair verifies the files protected by s, and repairs any damaged or missing slices using the recovery slices of
+// s. Damage is only repaired once all recovery volumes of s are present, and none of its files have been modified
+// within delay. A report is returned if verification succeeds, even if there are too few recovery slices to repair
+// the damage.
+func (s *Set) Repair(ctx context.Context, delay time.Duration) (Report, error) {
+	d, blocks, err := s.verify(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+	report := Report{Blocks: blocks, Damaged: len(d.slices), Recovery: len(s.recovery)}
+	if len(d.files) == 0 {
+		return report, nil
+	}
+	if err := s.ready(delay); err != nil {
+		return report, err
+	}
+	if report.Damaged > report.Recovery {
+		return report, nil
+	}
+	var slices map[int][]byte
+	if report.Damaged > 0 {
+		if slices, err = s.reconstruct(ctx, d); err != nil {
+			return report, fmt.Errorf("repair failed: %w", err)
+		}
+	}
+	for _, f := range d.files {
+		if err := s.rewrite(f, slices); err != nil {
+			return report, fmt.Errorf("repair failed: %w", err)
+		}
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// Options configures how a Handler repairs sets.
+type Options struct {
+	// Delay is the duration the files of a set must be left unchanged before the set is repaired.
+	Delay time.Duration
+}
+
+// Handler verifies and repairs sets of files protected by PAR2 files.
+type Handler struct {
+	locks syncutil.KeyMutex
+	cache *Cache
+	opts  Options
+}
+
+func NewHandler(opts Options) *Handler { return &Handler{cache: NewCache(), opts: opts} }
+
+func (h *Handler) Handle(ctx context.Context, name, postCommand string, remove bool) error {
+	s, err := h.cache.Find(name)
+	if err != nil {
+		return err
+	}
+	defer h.locks.Lock(s.Key())()
+	dir := filepath.Dir(s.Name)
+	if manifest.Unpacked(ctx, dir, s.Name) {
+		return nil
+	}
+	report, err := s.Repair(ctx, h.opts.Delay)
+	if errors.Is(err, ErrNotReady) {
+		return fmt.Errorf("incomplete: %s: %w", dir, err)
+	} else if err != nil {
+		return fmt.Errorf("verification failed: %s: %w", dir, err)
+	}
+	if !report.OK() {
+		return fmt.Errorf("incomplete: %s: %s", dir, report)
+	}
+	log.Printf("verified %s: %s", s.Name, report)
+	h.cache.Forget(s)
+	// The protected files are recorded as the volumes of the set, so that the set is verified again if they change
+	if err := manifest.Record(dir, s.Name, s.Paths(), nil); err != nil {
+		log.Printf("failed to write manifest: %s: %s", dir, err)
+	}
+	if remove {
+		for _, name := range s.Files {
+			if err := os.Remove(name); err != nil {
+				return fmt.Errorf("removal failed: %s: %w", dir, err)
+			}
+		}
+	}
+	cd := executil.CommandData{Base: filepath.Base(s.Name), Dir: dir, Name: s.Name}
+	if err := executil.Run(ctx, postCommand, cd); err != nil {
+		return fmt.Errorf("post-process command failed: %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package par2
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePacket(b *bytes.Buffer, setID [16]byte, typ [16]byte, body []byte) {
+	h := md5.New()
+	h.Write(setID[:])
+	h.Write(typ[:])
+	h.Write(body)
+	b.Write(magic[:])
+	binary.Write(b, binary.LittleEndian, uint64(headerSize+len(body)))
+	b.Write(h.Sum(nil))
+	b.Write(setID[:])
+	b.Write(typ[:])
+	b.Write(body)
+}
+
+// typeCreator is the type of creator packets, which identify the program that created a set. They are ignored when
+// reading a set, but written by par2cmdline and others.
+var typeCreator = packetType("PAR 2.0\x00Creator\x00")
+
+// writePar2 writes a PAR2 set protecting the given files in dir, with a index file named name.par2 and a recovery
+// volume holding the given number of recovery slices. Packets are laid out as par2cmdline does, ending each file with
+// a creator packet.
+func writePar2(t *testing.T, dir, name string, sliceSize int, recovery int, files ...string) {
+	t.Helper()
+	type input struct {
+		id   [16]byte
+		name string
+		data []byte
+	}
+	var inputs []input
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash16k := md5.Sum(data[:min(len(data), 16384)])
+		var b bytes.Buffer
+		b.Write(hash16k[:])
+		binary.Write(&b, binary.LittleEndian, uint64(len(data)))
+		b.WriteString(f)
+		inputs = append(inputs, input{id: md5.Sum(b.Bytes()), name: f, data: data})
+	}
+	sort.Slice(inputs, func(i, j int) bool { return bytes.Compare(inputs[i].id[:], inputs[j].id[:]) < 0 })
+
+	var main bytes.Buffer
+	binary.Write(&main, binary.LittleEndian, uint64(sliceSize))
+	binary.Write(&main, binary.LittleEndian, uint32(len(inputs)))
+	for _, in := range inputs {
+		main.Write(in.id[:])
+	}
+	setID := md5.Sum(main.Bytes())
+
+	var index bytes.Buffer
+	writePacket(&index, setID, typeMain, main.Bytes())
+	var slices [][]byte
+	for _, in := range inputs {
+		var desc bytes.Buffer
+		hash := md5.Sum(in.data)
+		hash16k := md5.Sum(in.data[:min(len(in.data), 16384)])
+		desc.Write(in.id[:])
+		desc.Write(hash[:])
+		desc.Write(hash16k[:])
+		binary.Write(&desc, binary.LittleEndian, uint64(len(in.data)))
+		desc.WriteString(in.name)
+		desc.Write(make([]byte, (4-len(in.name)%4)%4))
+		writePacket(&index, setID, typeFileDesc, desc.Bytes())
+
+		var ifsc bytes.Buffer
+		ifsc.Write(in.id[:])
+		for off := 0; off < len(in.data); off += sliceSize {
+			slice := make([]byte, sliceSize)
+			copy(slice, in.data[off:])
+			hash := md5.Sum(slice)
+			ifsc.Write(hash[:])
+			binary.Write(&ifsc, binary.LittleEndian, crc32.ChecksumIEEE(slice))
+			slices = append(slices, slice)
+		}
+		writePacket(&index, setID, typeIFSC, ifsc.Bytes())
+	}
+	writePacket(&index, setID, typeCreator, []byte("Created by par2cmdline version 0.8.1.\x00\x00\x00"))
+	if err := os.WriteFile(filepath.Join(dir, name+".par2"), index.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	constants := inputConstants(len(slices))
+	var vol bytes.Buffer
+	for e := 0; e < recovery; e++ {
+		body := make([]byte, 4+sliceSize)
+		binary.LittleEndian.PutUint32(body, uint32(e))
+		for i, slice := range slices {
+			mulAdd(body[4:], slice, gfPow(constants[i], uint32(e)))
+		}
+		writePacket(&vol, setID, typeRecovery, body)
+	}
+	// Recovery volumes repeat the other packets of the set
+	vol.Write(index.Bytes())
+	volName := filepath.Join(dir, fmt.Sprintf("%s.vol00+%02d.par2", name, recovery))
+	if err := os.WriteFile(volName, vol.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+var testFiles = map[string][]byte{
+	"a.bin": bytes.Repeat([]byte("0123456789abcdef"), 20),  // 5 slices
+	"b.bin": bytes.Repeat([]byte("fedcba9876543210"), 10),  // 3 slices, the last one padded
+	"c.bin": []byte("short file, not a multiple of four!"), // 1 slice
+}
+
+func writeTestSet(t *testing.T, recovery int) string {
+	dir := t.TempDir()
+	var names []string
+	for name, data := range testFiles {
+		writeFile(t, filepath.Join(dir, name), data)
+		names = append(names, name)
+	}
+	writePar2(t, dir, "test", 64, recovery, names...)
+	return dir
+}
+
+func TestRepair(t *testing.T) {
+	var tests = []struct {
+		damage func(dir string)
+		report Report
+	}{
+		{func(dir string) {}, Report{Blocks: 9, Recovery: 4}},
+		{func(dir string) {
+			data := bytes.Clone(testFiles["a.bin"])
+			data[70] = 'x'
+			writeFile(t, filepath.Join(dir, "a.bin"), data)
+		}, Report{Blocks: 9, Damaged: 1, Recovery: 4, Repaired: true}},
+		{func(dir string) {
+			os.Remove(filepath.Join(dir, "b.bin"))
+			data := bytes.Clone(testFiles["c.bin"])
+			data[0] = 'x'
+			writeFile(t, filepath.Join(dir, "c.bin"), data)
+		}, Report{Blocks: 9, Damaged: 4, Recovery: 4, Repaired: true}},
+		{func(dir string) {
+			writeFile(t, filepath.Join(dir, "a.bin"), testFiles["a.bin"][:100])
+		}, Report{Blocks: 9, Damaged: 4, Recovery: 4, Repaired: true}},
+		{func(dir string) {
+			writeFile(t, filepath.Join(dir, "c.bin"), append(bytes.Clone(testFiles["c.bin"]), "trailing"...))
+		}, Report{Blocks: 9, Damaged: 0, Recovery: 4, Repaired: true}},
+		{func(dir string) {
+			os.Remove(filepath.Join(dir, "a.bin"))
+		}, Report{Blocks: 9, Damaged: 5, Recovery: 4}},
+	}
+	for i, tt := range tests {
+		dir := writeTestSet(t, 4)
+		tt.damage(dir)
+		s, err := Find(filepath.Join(dir, "a.bin"))
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		report, err := s.Repair(context.Background(), 0)
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if report != tt.report {
+			t.Errorf("#%d: want %+v, got %+v", i, tt.report, report)
+		}
+		if !report.OK() {
+			continue
+		}
+		for name, data := range testFiles {
+			if got := readFile(t, filepath.Join(dir, name)); !bytes.Equal(data, got) {
+				t.Errorf("#%d: want %s to be repaired, got %q", i, name, got)
+			}
+		}
+	}
+}
+
+func TestRepairDamagedVolume(t *testing.T) {
+	dir := writeTestSet(t, 3)
+	// Damage the body of the first recovery slice
+	vol := filepath.Join(dir, "test.vol00+03.par2")
+	data := readFile(t, vol)
+	data[headerSize+4+10] ^= 0xff
+	writeFile(t, vol, data)
+	// Damage two input slices, leaving exactly enough intact recovery slices
+	a := bytes.Clone(testFiles["a.bin"])
+	a[0], a[300] = 'x', 'x'
+	writeFile(t, filepath.Join(dir, "a.bin"), a)
+
+	s, err := Find(filepath.Join(dir, "test.par2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.Repair(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Report{Blocks: 9, Damaged: 2, Recovery: 3, Repaired: true}); report != want {
+		t.Errorf("want %+v, got %+v", want, report)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.bin")); !bytes.Equal(testFiles["a.bin"], got) {
+		t.Errorf("want a.bin to be repaired, got %q", got)
+	}
+}
+
+func TestRepairNotReady(t *testing.T) {
+	var tests = []struct {
+		volume string
+		delay  time.Duration
+		err    string
+	}{
+		{"test.vol00+03.par2", 0, "not ready for repair: incomplete recovery volume: test.vol00+03.par2"},
+		{"test.vol02+02.par2", 0, "not ready for repair: missing recovery volume for blocks 0-1"},
+		{"test.vol00+02.par2", time.Hour, "not ready for repair: files are still changing: "},
+	}
+	for i, tt := range tests {
+		dir := writeTestSet(t, 2)
+		if err := os.Rename(filepath.Join(dir, "test.vol00+02.par2"), filepath.Join(dir, tt.volume)); err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Clone(testFiles["a.bin"])
+		data[0] = 'x'
+		writeFile(t, filepath.Join(dir, "a.bin"), data)
+		s, err := Find(filepath.Join(dir, "a.bin"))
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if _, err := s.Repair(context.Background(), tt.delay); !errors.Is(err, ErrNotReady) || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+		}
+		if got := readFile(t, filepath.Join(dir, "a.bin")); !bytes.Equal(data, got) {
+			t.Errorf("#%d: want a.bin to be left as is", i)
+		}
+	}
+}
+
+func TestCacheFind(t *testing.T) {
+	dir := writeTestSet(t, 2)
+	c := NewCache()
+	index := filepath.Join(dir, "test.par2")
+	s, err := c.Find(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(c.files); want != got {
+		t.Errorf("want %d cached files, got %d", want, got)
+	}
+	// A changed file is read again
+	writePar2(t, dir, "test", 64, 3, "a.bin")
+	if s, err = c.Find(index); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(s.Paths()); want != got {
+		t.Errorf("want %d protected files, got %d", want, got)
+	}
+	// Removed files are forgotten
+	os.Remove(filepath.Join(dir, "test.vol00+02.par2"))
+	if s, err = c.Find(index); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(c.files); want != got {
+		t.Errorf("want %d cached files, got %d", want, got)
+	}
+	c.Forget(s)
+	if want, got := 0, len(c.files); want != got {
+		t.Errorf("want %d cached files, got %d", want, got)
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir := writeTestSet(t, 2)
+	for _, name := range []string{"test.par2", "test.vol00+02.par2", "b.bin"} {
+		s, err := Find(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if want := filepath.Join(dir, "test.par2"); s.Name != want {
+			t.Errorf("%s: want set name %s, got %s", name, want, s.Name)
+		}
+		if want, got := 2, len(s.Files); want != got {
+			t.Errorf("%s: want %d par2 files, got %d", name, want, got)
+		}
+		if want, got := 2, len(s.recovery); want != got {
+			t.Errorf("%s: want %d recovery slices, got %d", name, want, got)
+		}
+	}
+	if _, err := Find(filepath.Join(dir, "foo.nfo")); err == nil || !strings.HasPrefix(err.Error(), ErrNotFound.Error()) {
+		t.Errorf("want %q, got %v", ErrNotFound, err)
+	}
+}
+
+func TestReadPacketsDamaged(t *testing.T) {
+	dir := writeTestSet(t, 2)
+	name := filepath.Join(dir, "test.par2")
+	data := readFile(t, name)
+	want, err := readPackets(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Prefix garbage and damage the first packet
+	damaged := append([]byte("garbage!"), data...)
+	damaged[8+headerSize] ^= 0xff
+	writeFile(t, name, damaged)
+	got, err := readPackets(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want)-1 {
+		t.Errorf("want %d packets, got %d", len(want)-1, len(got))
+	}
+	// The set is still usable, as the recovery volume repeats the damaged packet
+	if _, err := Find(name); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadPacketsInvalidLength(t *testing.T) {
+	var setID [16]byte
+	var tests = []struct {
+		length uint64
+		body   []byte
+	}{
+		{1 << 63, nil},             // Negative as int64
+		{headerSize + 1024, nil},   // Truncated
+		{^uint64(0) - 3, nil},      // Larger than any file
+		{headerSize + 4, []byte{}}, // Truncated body
+	}
+	for i, tt := range tests {
+		var b bytes.Buffer
+		writePacket(&b, setID, typeMain, tt.body)
+		data := b.Bytes()
+		binary.LittleEndian.PutUint64(data[8:], tt.length)
+		name := filepath.Join(t.TempDir(), "test.par2")
+		writeFile(t, name, data)
+		packets, err := readPackets(name)
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if len(packets) != 0 {
+			t.Errorf("#%d: want no packets, got %d", i, len(packets))
+		}
+	}
+}
+
+func TestInvalidSliceSize(t *testing.T) {
+	// Slice size is capped
+	var main bytes.Buffer
+	binary.Write(&main, binary.LittleEndian, uint64(1<<40))
+	binary.Write(&main, binary.LittleEndian, uint32(0))
+	if _, err := parseMain(main.Bytes()); err == nil {
+		t.Error("want error for oversized slice size")
+	}
+
+	// Slice size must not exceed the protected files
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.bin"), []byte("foo!"))
+	writePar2(t, dir, "test", 1024, 0, "a.bin")
+	if _, err := Find(filepath.Join(dir, "test.par2")); err == nil {
+		t.Error("want error for slice size larger than protected files")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var (
+		dir    = writeTestSet(t, 2)
+		out    = filepath.Join(dir, "post")
+		script = filepath.Join(t.TempDir(), "post.sh")
+	)
+	writeFile(t, script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"))
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "c.bin"))
+	data := bytes.Clone(testFiles["a.bin"])
+	data[0], data[300] = 'x', 'x'
+	writeFile(t, filepath.Join(dir, "a.bin"), data)
+
+	h := NewHandler(Options{})
+	post := script + " {{.Name}} {{.Base}} {{.Dir}}"
+	want := "incomplete: " + dir + ": 3/9 blocks damaged, not repairable with 2 recovery blocks"
+	if err := h.Handle(context.Background(), filepath.Join(dir, "a.bin"), post, true); err == nil || err.Error() != want {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("want post-command to not run")
+	}
+
+	writeFile(t, filepath.Join(dir, "c.bin"), testFiles["c.bin"])
+	if err := h.Handle(context.Background(), filepath.Join(dir, "c.bin"), post, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.bin")); !bytes.Equal(testFiles["a.bin"], got) {
+		t.Errorf("want a.bin to be repaired, got %q", got)
+	}
+	index := filepath.Join(dir, "test.par2")
+	if want, got := index+" test.par2 "+dir+"\n", string(readFile(t, out)); want != got {
+		t.Errorf("want post-command output %q, got %q", want, got)
+	}
+	for _, name := range []string{index, filepath.Join(dir, "test.vol00+02.par2")} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed", name)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package pathutil
 
 import (
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
@@ -20,3 +22,68 @@ func ContainsHidden(path string) bool {
 	}
 	return false
 }
+
+func isSeparator(r rune) bool { return r == '/' || r == '\\' }
+
+// Join joins the relative path name to root. Absolute names and names containing parent directory references are
+// rejected, so that the returned path is always contained in root.
+func Join(root, name string) (string, error) {
+	if name == "" || isSeparator(rune(name[0])) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("absolute path: %s", name)
+	}
+	for _, elem := range strings.FieldsFunc(name, isSeparator) {
+		if elem == ".." {
+			return "", fmt.Errorf("path traversal: %s", name)
+		}
+	}
+	return filepath.Join(root, name), nil
+}
+
+// Contains returns whether the path name is equal to, or contained in, root. Both paths are cleaned lexically
+// before comparison.
+func Contains(root, name string) bool {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(name))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// Match returns whether the slash-separated path name matches the glob pattern. Patterns use the syntax of path.Match,
+// and additionally support "**", which matches zero or more path elements. A pattern not containing a slash matches
+// the last element of name at any depth. A pattern ending in a slash matches a directory and everything below it.
+func Match(pattern, name string) (bool, error) {
+	dir := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	if dir {
+		pattern += "/**"
+	}
+	name = strings.Trim(strings.ReplaceAll(name, `\`, "/"), "/")
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try matching the remaining pattern against every suffix of name
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchElems(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
@@ -37,3 +37,94 @@ func TestContainsHidden(t *testing.T) {
 		}
 	}
 }
+
+func TestJoin(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+		err string
+	}{
+		{"foo", "/root/foo", ""},
+		{"foo/bar", "/root/foo/bar", ""},
+		{"foo/./bar", "/root/foo/bar", ""},
+		{"foo..bar", "/root/foo..bar", ""},
+		{"", "", "absolute path: "},
+		{"/etc/cron.d/x", "", "absolute path: /etc/cron.d/x"},
+		{`\evil`, "", `absolute path: \evil`},
+		{"../../.bashrc", "", "path traversal: ../../.bashrc"},
+		{"foo/../bar", "", "path traversal: foo/../bar"},
+		{`foo\..\..\bar`, "", `path traversal: foo\..\..\bar`},
+	}
+	for _, tt := range tests {
+		got, err := Join("/root", tt.in)
+		if err != nil {
+			if err.Error() != tt.err {
+				t.Errorf("want error %q, got %q for %s", tt.err, err.Error(), tt.in)
+			}
+			continue
+		}
+		if tt.err != "" {
+			t.Errorf("want error %q for %s", tt.err, tt.in)
+		}
+		if got != tt.out {
+			t.Errorf("want %s, got %s for %s", tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out bool
+	}{
+		{"/root", true},
+		{"/root/foo", true},
+		{"/root/foo/../bar", true},
+		{"/root/..foo", true},
+		{"/root/../foo", false},
+		{"/rootfoo", false},
+		{"/", false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := Contains("/root", tt.in); got != tt.out {
+			t.Errorf("want %t, got %t for %s", tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		name    string
+		out     bool
+	}{
+		{"*.nfo", "foo.nfo", true},
+		{"*.nfo", "foo/bar.nfo", true},
+		{"*.nfo", "foo.mkv", false},
+		{"Sample/", "Sample", true},
+		{"Sample/", "Sample/foo.mkv", true},
+		{"Sample/", "foo/Sample/bar/foo.mkv", true},
+		{"Sample/", "Samples/foo.mkv", false},
+		{"foo/*.mkv", "foo/bar.mkv", true},
+		{"foo/*.mkv", "baz/foo/bar.mkv", false},
+		{"foo/**/*.mkv", "foo/bar.mkv", true},
+		{"foo/**/*.mkv", "foo/a/b/bar.mkv", true},
+		{"**/Proof/*", "a/Proof/b.jpg", true},
+		{"**/Proof/*", "a/Proof/b/c.jpg", false},
+		{"**", "foo/bar", true},
+		{`*.nfo`, `foo\bar.nfo`, true},
+	}
+	for i, tt := range tests {
+		got, err := Match(tt.pattern, tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.out {
+			t.Errorf("#%d: want %t, got %t for Match(%q, %q)", i, tt.out, got, tt.pattern, tt.name)
+		}
+	}
+	if _, err := Match("[", "foo"); err == nil {
+		t.Error("want error for bad pattern")
+	}
+}
@@ -0,0 +1,139 @@
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress describes how far a handler has come in unpacking an archive.
+type Progress struct {
+	Name    string
+	Entry   string
+	Done    int64
+	Total   int64
+	Elapsed time.Duration
+}
+
+// Func is called whenever progress is made.
+type Func func(Progress)
+
+type funcKey struct{}
+
+type trackerKey struct{}
+
+type tracker struct {
+	mu      sync.Mutex
+	fn      Func
+	started time.Time
+	p       Progress
+}
+
+// Throughput returns the number of bytes processed per second.
+func (p Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Done) / p.Elapsed.Seconds()
+}
+
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := float64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/div, "KMGTPE"[exp])
+}
+
+func (p Progress) String() string {
+	s := fmt.Sprintf("%s: %s: %s", p.Name, p.Entry, formatBytes(float64(p.Done)))
+	if p.Total > 0 {
+		s += fmt.Sprintf("/%s (%d%%)", formatBytes(float64(p.Total)), p.Done*100/p.Total)
+	}
+	return s + fmt.Sprintf(" at %s/s", formatBytes(p.Throughput()))
+}
+
+// WithFunc returns a copy of ctx that reports progress to fn.
+func WithFunc(ctx context.Context, fn Func) context.Context {
+	return context.WithValue(ctx, funcKey{}, fn)
+}
+
+// Start starts tracking progress of unpacking name, which contains total bytes. Progress is tracked in the returned
+// context, and reported to the Func in ctx. If ctx has no Func, ctx is returned unchanged.
+func Start(ctx context.Context, name string, total int64) context.Context {
+	fn, ok := ctx.Value(funcKey{}).(Func)
+	if !ok {
+		return ctx
+	}
+	t := &tracker{fn: fn, started: time.Now(), p: Progress{Name: name, Total: total}}
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+func trackerFrom(ctx context.Context) *tracker {
+	t, _ := ctx.Value(trackerKey{}).(*tracker)
+	return t
+}
+
+func (t *tracker) update(entry string, n int64) {
+	t.mu.Lock()
+	if entry != "" {
+		t.p.Entry = entry
+	}
+	t.p.Done += n
+	t.p.Elapsed = time.Since(t.started)
+	p := t.p
+	t.mu.Unlock()
+	t.fn(p)
+}
+
+// Reset discards the progress tracked in ctx, so that unpacking can start over, e.g. with another password.
+func Reset(ctx context.Context) {
+	t := trackerFrom(ctx)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.started = time.Now()
+	t.p.Entry = ""
+	t.p.Done = 0
+	t.p.Elapsed = 0
+	p := t.p
+	t.mu.Unlock()
+	t.fn(p)
+}
+
+// SetEntry sets the entry currently being unpacked.
+func SetEntry(ctx context.Context, entry string) {
+	if t := trackerFrom(ctx); t != nil {
+		t.update(entry, 0)
+	}
+}
+
+type reader struct {
+	t *tracker
+	r io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.update("", int64(n))
+	}
+	return n, err
+}
+
+// Reader returns a reader that counts bytes read from r as progress. If ctx is not tracking progress, r is returned.
+func Reader(ctx context.Context, r io.Reader) io.Reader {
+	t := trackerFrom(ctx)
+	if t == nil {
+		return r
+	}
+	return &reader{t: t, r: r}
+}
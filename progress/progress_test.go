@@ -0,0 +1,64 @@
+package progress
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	var got []Progress
+	ctx := WithFunc(context.Background(), func(p Progress) { got = append(got, p) })
+	ctx = Start(ctx, "foo.rar", 6)
+	SetEntry(ctx, "foo")
+	if _, err := io.Copy(io.Discard, Reader(ctx, strings.NewReader("foo"))); err != nil {
+		t.Fatal(err)
+	}
+	SetEntry(ctx, "bar")
+	if _, err := io.Copy(io.Discard, Reader(ctx, strings.NewReader("bar"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 {
+		t.Fatal("want progress to be reported")
+	}
+	last := got[len(got)-1]
+	if last.Name != "foo.rar" || last.Entry != "bar" || last.Done != 6 || last.Total != 6 {
+		t.Errorf("want foo.rar, bar, 6/6, got %s, %s, %d/%d", last.Name, last.Entry, last.Done, last.Total)
+	}
+
+	// Reset starts over
+	Reset(ctx)
+	if _, err := io.Copy(io.Discard, Reader(ctx, strings.NewReader("foo"))); err != nil {
+		t.Fatal(err)
+	}
+	if last := got[len(got)-1]; last.Entry != "" || last.Done != 3 || last.Total != 6 {
+		t.Errorf("want 3/6 with no entry after reset, got %q, %d/%d", last.Entry, last.Done, last.Total)
+	}
+
+	// Nothing is tracked without a Func
+	ctx = Start(context.Background(), "foo.rar", 3)
+	r := strings.NewReader("foo")
+	if got := Reader(ctx, r); got != r {
+		t.Error("want reader to be returned unchanged")
+	}
+}
+
+func TestString(t *testing.T) {
+	var tests = []struct {
+		in  Progress
+		out string
+	}{
+		{Progress{Name: "foo.rar", Entry: "foo", Done: 512, Elapsed: time.Second}, "foo.rar: foo: 512 B at 512 B/s"},
+		{Progress{Name: "foo.rar", Entry: "foo", Done: 1536, Total: 3072, Elapsed: time.Second},
+			"foo.rar: foo: 1.5 KiB/3.0 KiB (50%) at 1.5 KiB/s"},
+		{Progress{Name: "foo.rar", Entry: "foo", Done: 5 << 30, Total: 10 << 30, Elapsed: 10 * time.Second},
+			"foo.rar: foo: 5.0 GiB/10.0 GiB (50%) at 512.0 MiB/s"},
+	}
+	for i, tt := range tests {
+		if got := tt.in.String(); got != tt.out {
+			t.Errorf("#%d: want %q, got %q", i, tt.out, got)
+		}
+	}
+}
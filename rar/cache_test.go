@@ -0,0 +1,91 @@
+package rar
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mpolden/unp/unpack"
+)
+
+func TestHandlePersistentCache(t *testing.T) {
+	var (
+		td        = testDir(t)
+		dir       = t.TempDir()
+		cacheFile = filepath.Join(t.TempDir(), "cache.json")
+	)
+	for _, name := range []string{"test.rar", "test.r00", "test.sfv"} {
+		symlink(t, filepath.Join(td, name), filepath.Join(dir, name))
+	}
+
+	h := NewHandler(Options{VerifyOptions: unpack.VerifyOptions{CacheFile: cacheFile}})
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.rar"), "", false); err == nil {
+		t.Fatal("want error for incomplete set")
+	}
+
+	// A new handler, as created on reload, starts with the verified checksums
+	h = NewHandler(Options{VerifyOptions: unpack.VerifyOptions{CacheFile: cacheFile}})
+	if want, got := 2, h.cache.Len(); want != got {
+		t.Errorf("want %d cache entries, got %d", want, got)
+	}
+
+	// Completing the set clears its entries, even if volumes are kept
+	symlink(t, filepath.Join(td, "test.r01"), filepath.Join(dir, "test.r01"))
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.r01"), "", false); err != nil {
+		t.Fatal(err)
+	}
+	h = NewHandler(Options{VerifyOptions: unpack.VerifyOptions{CacheFile: cacheFile}})
+	if want, got := 0, h.cache.Len(); want != got {
+		t.Errorf("want %d cache entries, got %d", want, got)
+	}
+}
+
+func TestHandleReplacedVolume(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+	)
+	for _, name := range []string{"test.rar", "test.r00", "test.sfv"} {
+		data, err := os.ReadFile(filepath.Join(td, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewHandler(Options{})
+	want := "incomplete: " + dir + ": 2/3 files"
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.rar"), "", false); err == nil || err.Error() != want {
+		t.Fatalf("want err = %q, got %v", want, err)
+	}
+
+	// Replacing a verified volume with a corrupt one invalidates its entry
+	r00 := filepath.Join(dir, "test.r00")
+	if err := os.Remove(r00); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(r00, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want = "incomplete: " + dir + ": 1/3 files"
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.rar"), "", false); err == nil || err.Error() != want {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+	if want, got := 1, h.cache.Len(); want != got {
+		t.Errorf("want %d cache entries, got %d", want, got)
+	}
+
+	// Entries for files that disappeared are dropped
+	if err := os.Remove(filepath.Join(dir, "test.rar")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.r00"), "", false); err == nil {
+		t.Error("want error for incomplete set")
+	}
+	if want, got := 0, h.cache.Len(); want != got {
+		t.Errorf("want %d cache entries, got %d", want, got)
+	}
+}
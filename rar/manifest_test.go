@@ -0,0 +1,101 @@
+package rar
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/unpack"
+)
+
+func TestHandleManifest(t *testing.T) {
+	var (
+		td   = testDir(t)
+		src  = t.TempDir()
+		dest = t.TempDir()
+	)
+	for _, name := range []string{"test.rar", "test.r00", "test.r01", "test.sfv"} {
+		symlink(t, filepath.Join(td, name), filepath.Join(src, name))
+	}
+	first := filepath.Join(src, "test.rar")
+	test1 := filepath.Join(dest, "test1")
+	handle := func(ctx context.Context, h *Handler) {
+		t.Helper()
+		if err := h.Handle(ctx, first, "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tamper := func() {
+		t.Helper()
+		if err := os.WriteFile(test1, bytes.Repeat([]byte("x"), 512), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isTampered := func() bool {
+		t.Helper()
+		data, err := os.ReadFile(test1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Equal(data, bytes.Repeat([]byte("x"), 512))
+	}
+
+	// Unpacking records files and sources in manifest
+	h := NewHandler(Options{Options: unpack.Options{DestDir: dest}})
+	handle(context.Background(), h)
+	m, err := manifest.Read(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := m.Sets[first]
+	if !ok {
+		t.Fatalf("want manifest entry for %s", first)
+	}
+	if want, got := 4, len(s.Volumes); want != got {
+		t.Errorf("want %d volumes, got %d", want, got)
+	}
+	files := make(map[string]manifest.Entry)
+	for _, f := range s.Files {
+		files[f.Name] = f
+	}
+	for _, name := range []string{"test1", "test2", "test3", "nested.rar", "test/test4"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("want %s in manifest", name)
+		}
+	}
+	data, err := os.ReadFile(test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)), files["test1"].CRC32; want != got {
+		t.Errorf("want crc32 %s, got %s", want, got)
+	}
+
+	// Unchanged set is not unpacked again
+	tamper()
+	handle(context.Background(), h)
+	if !isTampered() {
+		t.Error("want set to not be unpacked again")
+	}
+
+	// Set is unpacked again if an unpacked file is missing
+	if err := os.Remove(filepath.Join(dest, "test2")); err != nil {
+		t.Fatal(err)
+	}
+	handle(context.Background(), h)
+	if isTampered() {
+		t.Error("want set to be unpacked again")
+	}
+
+	// Force always unpacks
+	tamper()
+	handle(manifest.WithForce(context.Background()), h)
+	if isTampered() {
+		t.Error("want set to be unpacked again when forced")
+	}
+}
@@ -1,58 +1,128 @@
 package rar
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
-	"regexp"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/mpolden/sfv"
 	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/par2"
+	"github.com/mpolden/unp/pathutil"
+	"github.com/mpolden/unp/progress"
+	"github.com/mpolden/unp/sfvutil"
+	"github.com/mpolden/unp/syncutil"
+	"github.com/mpolden/unp/unpack"
 	"github.com/nwaples/rardecode/v2"
 )
 
-var rarPartRE = regexp.MustCompile(`\.part0*(\d+)\.rar$`)
+// errEncryptedEntry is returned along with a checksum error when the entry is encrypted. RAR 4 archives have no
+// password check, so such a mismatch is likely caused by a wrong password rather than corruption.
+var errEncryptedEntry = errors.New("encrypted entry")
 
-type event struct {
-	Base string
-	Dir  string
-	Name string
-	sfv  *sfv.SFV
+// passwordErrors are the errors caused by an incorrect password, when file data is encrypted. A checksum error of an
+// entry that is not encrypted is not one of them, as it means that the archive is corrupt.
+var passwordErrors = []error{
+	rardecode.ErrArchiveEncrypted,
+	rardecode.ErrArchivedFileEncrypted,
+	rardecode.ErrBadPassword,
+	errEncryptedEntry,
+}
+
+// headerPasswordErrors are the additional errors caused by an incorrect password, when headers are encrypted.
+var headerPasswordErrors = []error{
+	rardecode.ErrBadHeaderCRC,
+	rardecode.ErrCorruptBlockHeader,
+	rardecode.ErrCorruptFileHeader,
+}
+
+// Options configures how a Handler unpacks archives.
+type Options struct {
+	unpack.Options
+	unpack.VerifyOptions
+	// Completeness sets how to determine whether a RAR set is complete. This is one of CompletenessSFV (default),
+	// CompletenessHeaders or CompletenessAuto.
+	Completeness string
+	// HardLinks unpacks hard links as links to a previously unpacked file.
+	HardLinks bool
+	// Par2 repairs sets that are incomplete using PAR2 files next to them, before unpacking.
+	Par2 bool
+	// Par2Delay is the duration the files of a set must be left unchanged before the set is repaired.
+	Par2Delay time.Duration
 }
 
 type Handler struct {
-	mu    sync.Mutex
-	cache map[string]bool
+	locks syncutil.KeyMutex
+	cache *sfvutil.Cache
+	par2  *par2.Cache
+	opts  Options
 }
 
-func eventFrom(filename string) (event, error) {
-	dir := filepath.Dir(filename)
-	sfv, err := sfv.Find(dir)
+// sfvFor returns the SFV in sfvs describing the set that filename belongs to.
+func sfvFor(filename string, sfvs []*sfv.SFV) *sfv.SFV {
+	return sfvutil.Find(filename, sfvs, firstVolume)
+}
+
+func sfvEvent(filename string, s *sfv.SFV) (unpack.Set, error) {
+	rar, err := findFirstRAR(s)
 	if err != nil {
-		return event{}, err
+		return unpack.Set{}, err
 	}
-	rar, err := findFirstRAR(sfv)
+	return unpack.Set{
+		SFV:  s,
+		Base: filepath.Base(rar),
+		Dir:  filepath.Dir(filename),
+		Name: rar,
+	}, nil
+}
+
+func headerEventFrom(filename string) (unpack.Set, error) {
+	rar, err := firstVolume(filename)
 	if err != nil {
-		return event{}, err
+		return unpack.Set{}, err
 	}
-	return event{
-		sfv:  sfv,
+	return unpack.Set{
 		Base: filepath.Base(rar),
-		Dir:  dir,
+		Dir:  filepath.Dir(rar),
 		Name: rar,
 	}, nil
 }
 
-func isRAR(name string) bool { return filepath.Ext(name) == ".rar" }
+func (h *Handler) eventFrom(filename string) (unpack.Set, error) {
+	if h.opts.Completeness == CompletenessHeaders {
+		return headerEventFrom(filename)
+	}
+	dir := filepath.Dir(filename)
+	sfvs, err := sfvutil.ReadDir(dir)
+	if err != nil {
+		return unpack.Set{}, err
+	}
+	s := sfvFor(filename, sfvs)
+	if s == nil {
+		if h.opts.Completeness == CompletenessAuto {
+			return headerEventFrom(filename)
+		}
+		if len(sfvs) == 0 {
+			return unpack.Set{}, fmt.Errorf("no sfv found in %s", dir)
+		}
+		return unpack.Set{}, fmt.Errorf("no sfv found for %s", filename)
+	}
+	return sfvEvent(filename, s)
+}
 
 func isFirstRAR(name string) bool {
-	m := rarPartRE.FindStringSubmatch(name)
-	if len(m) == 2 {
-		return m[1] == "1"
-	}
-	return isRAR(name)
+	first, err := firstVolume(name)
+	return err == nil && first == name
 }
 
 func findFirstRAR(s *sfv.SFV) (string, error) {
@@ -71,119 +141,384 @@ func chtimes(name string, header *rardecode.FileHeader) error {
 	return os.Chtimes(name, header.ModificationTime, header.ModificationTime)
 }
 
-func unpack(filename string) error {
-	r, err := rardecode.OpenReader(filename)
+func isSymlink(header *rardecode.FileHeader) bool { return header.Mode()&fs.ModeSymlink != 0 }
+
+func isHardLink(header *rardecode.FileHeader) bool {
+	return header.LinkType == rardecode.LinkTypeHardLink
+}
+
+// readSymlink returns the target of the symbolic link described by header. RAR 5 archives store the target in the
+// header, while older archives store it as the file contents.
+func readSymlink(header *rardecode.FileHeader, r io.Reader) (string, error) {
+	if header.LinkTarget != "" {
+		return filepath.FromSlash(strings.ReplaceAll(header.LinkTarget, `\`, "/")), nil
+	}
+	target, err := io.ReadAll(io.LimitReader(r, unpack.MaxLinkSize))
 	if err != nil {
-		return fmt.Errorf("failed to open %s: %w", filename, err)
+		return "", err
 	}
-	dir := filepath.Dir(filename)
+	return string(target), nil
+}
+
+// chmod sets the permission bits of name to the ones stored in header, if header was created on a Unix system.
+// Directories always remain accessible to their owner, so that they can be written to and published.
+func chmod(name string, header *rardecode.FileHeader) error {
+	if header.HostOS != rardecode.HostOSUnix {
+		return nil
+	}
+	mode := header.Mode().Perm()
+	if header.IsDir {
+		mode |= 0700
+	}
+	return os.Chmod(name, mode)
+}
+
+// copyEntry copies the contents of the entry described by header from r to w. Contents are hashed by rardecode while
+// being copied, and compared to the CRC32 (RAR 4) or BLAKE2sp (RAR 5) hash stored in the header once the end of the
+// entry is reached. The number of bytes copied and their CRC32 is returned.
+func copyEntry(ctx context.Context, w io.Writer, r io.Reader, header *rardecode.FileHeader) (int64, uint32, error) {
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, hash), unpack.Reader(ctx, r))
+	if errors.Is(err, rardecode.ErrBadFileChecksum) && header.Encrypted {
+		return 0, 0, fmt.Errorf("checksum mismatch: %s: %w: %w", header.Name, errEncryptedEntry, err)
+	} else if errors.Is(err, rardecode.ErrBadFileChecksum) {
+		return 0, 0, fmt.Errorf("checksum mismatch: %s: %w", header.Name, err)
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+	}
+	if !isSymlink(header) && !header.UnKnownSize && n != header.UnPackedSize {
+		return 0, 0, fmt.Errorf("size mismatch: %s: want %d bytes, got %d", header.Name, header.UnPackedSize, n)
+	}
+	return n, hash.Sum32(), nil
+}
+
+// skip returns whether the entry name should be skipped. See unpack.Options.SkipNested.
+func (h *Handler) skip(name string) bool { return h.opts.SkipNested(name, firstVolume) }
+
+// unpack unpacks the archive filename to dir. Existing files in dest, which is the directory that dir is eventually
+// published to, are handled according to the overwrite policy. Depth is the nesting depth of filename. The regular
+// files that were unpacked are returned, relative to dir.
+func (h *Handler) unpack(ctx context.Context, filename, dir, dest string, depth int, opts ...rardecode.Option) ([]manifest.Entry, error) {
+	r, err := rardecode.OpenReader(filename, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer r.Close()
+	var volumes []string
+	var files []manifest.Entry
+	links := make(unpack.Links)
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		header, err := r.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
+		}
+		// Skipped entries are read past by the next call to Next
+		if h.skip(header.Name) {
+			continue
+		}
+		name, err := pathutil.Join(dir, header.Name)
+		if err != nil {
+			if err := h.opts.Unsafe(filename, err); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		name := filepath.Join(dir, header.Name)
 		// If entry is a directory, create it and set correct ctime
 		if header.IsDir {
 			if err := os.MkdirAll(name, 0755); err != nil {
-				return err
+				return nil, err
+			}
+			if h.opts.PreserveMode {
+				if err := chmod(name, header); err != nil {
+					return nil, err
+				}
 			}
 			if err := chtimes(name, header); err != nil {
-				return err
+				return nil, err
 			}
 			continue
 		}
-		// Files can come before their containing folders, ensure that parent is created
-		parent := filepath.Dir(name)
-		if err := os.MkdirAll(parent, 0755); err != nil {
-			return err
+		var src io.Reader = r
+		var symlinkTo, hardLinkTo string
+		if isSymlink(header) {
+			target, err := readSymlink(header, r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+			}
+			if !h.opts.Symlinks {
+				// Write the link target as file contents, which is safe wherever it points
+				src = strings.NewReader(target)
+			} else if err := unpack.CheckSymlink(dir, name, target); err != nil {
+				if err := h.opts.Unsafe(filename, fmt.Errorf("%s: %w", header.Name, err)); err != nil {
+					return nil, err
+				}
+				continue
+			} else {
+				symlinkTo = target
+			}
+		} else if isHardLink(header) && h.opts.HardLinks {
+			// Hard link targets are relative to the archive root
+			if _, err := pathutil.Join(dir, header.LinkTarget); err != nil {
+				if err := h.opts.Unsafe(filename, fmt.Errorf("%s: %w", header.Name, err)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			var ok bool
+			if hardLinkTo, ok = links.Target(header.LinkTarget); !ok {
+				log.Printf("skipping hard link in %s: %s: target not unpacked: %s", filename, header.Name, header.LinkTarget)
+				continue
+			}
 		}
-		if err := chtimes(parent, header); err != nil {
-			return err
+		name, err = h.opts.Target(dir, dest, name, header.Name, header.ModificationTime)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		if err := chtimes(filepath.Dir(name), header); err != nil {
+			return nil, err
+		}
+		if symlinkTo != "" || hardLinkTo != "" {
+			if err := unpack.Link(name, symlinkTo, hardLinkTo); err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+			}
+			if hardLinkTo != "" {
+				links.Add(header.Name, name)
+			}
+			continue
 		}
 		// Unpack file
+		progress.SetEntry(ctx, header.Name)
 		f, err := os.Create(name)
 		if err != nil {
-			return fmt.Errorf("failed to create file: %s: %w", name, err)
+			return nil, fmt.Errorf("failed to create file: %s: %w", name, err)
 		}
-		if _, err = io.Copy(f, r); err != nil {
-			return err
+		n, crc, err := copyEntry(ctx, f, src, header)
+		if err != nil {
+			f.Close()
+			return nil, err
 		}
 		if err := f.Close(); err != nil {
-			return err
+			return nil, err
+		}
+		if h.opts.PreserveMode {
+			if err := chmod(name, header); err != nil {
+				return nil, err
+			}
 		}
 		// Set correct ctime of unpacked file
 		if err := chtimes(name, header); err != nil {
-			return err
+			return nil, err
 		}
-		// Unpack recursively if unpacked file is also a RAR
-		if isRAR(name) {
-			if err := unpack(name); err != nil {
-				return err
-			}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, manifest.Entry{Name: filepath.ToSlash(rel), Size: n, CRC32: fmt.Sprintf("%08x", crc)})
+		links.Add(header.Name, name)
+		if _, err := firstVolume(name); err == nil {
+			volumes = append(volumes, name)
 		}
 	}
-	return nil
+	return h.opts.UnpackNested(ctx, dir, dest, depth, files, volumes, firstVolume,
+		func(ctx context.Context, first, dest string, depth int) ([]manifest.Entry, error) {
+			size, _ := unpackedSize(first, h.skip, opts...)
+			ctx = progress.Start(ctx, filepath.Join(dest, filepath.Base(first)), size)
+			return h.unpack(ctx, first, filepath.Dir(first), dest, depth, opts...)
+		})
 }
 
-func (h *Handler) remove(sfv *sfv.SFV) error {
-	for _, c := range sfv.Checksums {
-		if err := os.Remove(c.Path); err != nil {
-			return err
+func isEncrypted(err error) bool {
+	return errors.Is(err, rardecode.ErrArchiveEncrypted) || errors.Is(err, rardecode.ErrArchivedFileEncrypted)
+}
+
+// isPasswordError returns whether err is caused by an incorrect password. Header errors are only caused by the
+// password if headers are encrypted.
+func isPasswordError(err error, headersEncrypted bool) bool {
+	errs := passwordErrors
+	if headersEncrypted {
+		errs = append(errs[:len(errs):len(errs)], headerPasswordErrors...)
+	}
+	for _, e := range errs {
+		if errors.Is(err, e) {
+			return true
 		}
-		delete(h.cache, c.Path)
 	}
-	return os.Remove(sfv.Path)
+	return false
 }
 
-func NewHandler() *Handler { return &Handler{cache: make(map[string]bool)} }
+// unpackTo unpacks filename into a staging directory, and publishes the staged files to dest if successful.
+func (h *Handler) unpackTo(ctx context.Context, filename, dest string, opts ...rardecode.Option) ([]manifest.Entry, error) {
+	return h.opts.Staged(dest, func(dir string) ([]manifest.Entry, error) {
+		return h.unpack(ctx, filename, dir, dest, 0, opts...)
+	})
+}
 
-func (h *Handler) verify(sfv *sfv.SFV) (int, int, error) {
-	passed := 0
-	for _, c := range sfv.Checksums {
-		ok := h.cache[c.Path]
-		if !ok && c.IsExist() {
-			var err error
-			ok, err = c.Verify()
-			if err != nil {
-				return 0, 0, err
-			}
-			h.cache[c.Path] = ok
+// readHeaders calls read to read the headers of the RAR set starting with filename. If the headers are encrypted, read
+// is called again with each configured password, until one decrypts the headers.
+func (h *Handler) readHeaders(filename string, read func(opts ...rardecode.Option) error) error {
+	err := read()
+	if !errors.Is(err, rardecode.ErrArchiveEncrypted) {
+		return err
+	}
+	passwords, err := unpack.Passwords(filepath.Dir(filename), h.opts.Passwords, h.opts.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("failed to read passwords: %w", err)
+	}
+	for _, password := range passwords {
+		if err := read(rardecode.Password(password)); !isPasswordError(err, true) {
+			return err
 		}
-		if ok {
-			passed++
+	}
+	return fmt.Errorf("no password worked: tried %d password(s): %w", len(passwords), rardecode.ErrArchiveEncrypted)
+}
+
+// checkSpace returns the unpacked size of filename, and an error if dest does not have room for it. The returned size
+// is zero if it cannot be known before unpacking.
+func (h *Handler) checkSpace(filename, dest string) (int64, error) {
+	var size int64
+	err := h.readHeaders(filename, func(opts ...rardecode.Option) (err error) {
+		size, err = unpackedSize(filename, h.skip, opts...)
+		return err
+	})
+	if isEncrypted(err) {
+		return 0, nil // No password decrypts the headers, so the size is unknown until unpacking
+	} else if err != nil {
+		return 0, err
+	}
+	return size, fsutil.CheckSpace(dest, size, h.opts.ReserveSpace)
+}
+
+// extract unpacks filename to dest. If the archive is encrypted, each configured password is tried in turn, until one
+// passes the password check of the archive and the checksums of its encrypted files.
+func (h *Handler) extract(ctx context.Context, filename, dest string) ([]manifest.Entry, error) {
+	files, err := h.unpackTo(ctx, filename, dest)
+	if !isEncrypted(err) {
+		return files, err
+	}
+	headersEncrypted := errors.Is(err, rardecode.ErrArchiveEncrypted)
+	passwords, err := unpack.Passwords(filepath.Dir(filename), h.opts.Passwords, h.opts.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passwords: %w", err)
+	}
+	for _, password := range passwords {
+		// Progress of the failed attempt does not count towards the total
+		progress.Reset(ctx)
+		files, err := h.unpackTo(ctx, filename, dest, rardecode.Password(password))
+		if err == nil || !isPasswordError(err, headersEncrypted) {
+			return files, err
 		}
 	}
-	return passed, len(sfv.Checksums), nil
+	return nil, fmt.Errorf("archive is encrypted and no password worked: %s: tried %d password(s)", filename, len(passwords))
 }
 
-func (h *Handler) Handle(name, postCommand string, removeRARs bool) error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	ev, err := eventFrom(name)
+// verify returns an error if set is incomplete.
+func (h *Handler) verify(ctx context.Context, set *unpack.Set) error {
+	if set.SFV != nil {
+		return set.Verify(ctx, h.cache, h.opts.VerifyWorkers)
+	}
+	// Without a SFV, the set is complete when all volume headers can be read. File checksums stored in the headers
+	// are verified while unpacking
+	var volumes []string
+	err := h.readHeaders(set.Name, func(opts ...rardecode.Option) (err error) {
+		volumes, err = readVolumes(set.Name, opts...)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("incomplete: %s: %w", set.Dir, err)
+	}
+	set.Volumes = volumes
+	return nil
+}
+
+// repair repairs set using the PAR2 set protecting its first volume.
+func (h *Handler) repair(ctx context.Context, set unpack.Set) error {
+	s, err := h.par2.Find(set.Name)
+	if err != nil {
+		return err
+	}
+	report, err := s.Repair(ctx, h.opts.Par2Delay)
+	if errors.Is(err, par2.ErrNotReady) {
+		return fmt.Errorf("incomplete: %s: %w", set.Dir, err)
+	} else if err != nil {
+		return fmt.Errorf("verification failed: %s: %w", set.Dir, err)
+	}
+	if !report.OK() {
+		return fmt.Errorf("incomplete: %s: %s", set.Dir, report)
+	}
+	log.Printf("verified %s: %s", s.Name, report)
+	h.par2.Forget(s)
+	return nil
+}
+
+func NewHandler(opts Options) *Handler {
+	return &Handler{
+		cache: opts.LoadCache(),
+		par2:  par2.NewCache(),
+		opts:  opts,
+	}
+}
+
+// Close stops pruning the verification cache of the handler.
+func (h *Handler) Close() { h.cache.Close() }
+
+func (h *Handler) Handle(ctx context.Context, name, postCommand string, removeRARs bool) error {
+	ev, err := h.eventFrom(name)
 	if err != nil {
 		return err
 	}
-	passed, total, err := h.verify(ev.sfv)
+	defer h.locks.Lock(ev.Key())()
+	cd := ev.CommandData()
+	dest, err := h.opts.Dest(cd)
 	if err != nil {
-		return fmt.Errorf("verification failed: %s: %w", ev.Dir, err)
+		return fmt.Errorf("invalid destination: %s: %w", ev.Dir, err)
+	}
+	if manifest.Unpacked(ctx, dest, ev.Name) {
+		return nil
+	}
+	if err := h.verify(ctx, &ev); err != nil {
+		if !h.opts.Par2 {
+			return err
+		}
+		if rerr := h.repair(ctx, ev); errors.Is(rerr, par2.ErrNotFound) {
+			return err
+		} else if rerr != nil {
+			return rerr
+		}
+		if err := h.verify(ctx, &ev); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
 	}
-	if passed != total {
-		return fmt.Errorf("incomplete: %s: %d/%d files", ev.Dir, passed, total)
+	size, err := h.checkSpace(ev.Name, dest)
+	if err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
 	}
-	if err := unpack(ev.Name); err != nil {
+	ctx = progress.Start(ctx, ev.Name, size)
+	files, err := h.extract(ctx, ev.Name, dest)
+	if err != nil {
 		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
 	}
+	if err := manifest.Record(dest, ev.Name, ev.Sources(), files); err != nil {
+		log.Printf("failed to write manifest: %s: %s", dest, err)
+	}
+	ev.Forget(h.cache)
 	if removeRARs {
-		if err := h.remove(ev.sfv); err != nil {
+		if err := ev.Remove(); err != nil {
 			return fmt.Errorf("removal failed: %s: %w", ev.Dir, err)
 		}
 	}
-	cd := executil.CommandData{Base: ev.Base, Dir: ev.Dir, Name: ev.Name}
-	if err := executil.Run(postCommand, cd); err != nil {
+	if err := executil.Run(ctx, postCommand, cd); err != nil {
 		return fmt.Errorf("post-process command failed: %s: %w", ev.Dir, err)
 	}
 	return nil
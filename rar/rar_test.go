@@ -1,13 +1,24 @@
 package rar
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/mpolden/sfv"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/progress"
+	"github.com/mpolden/unp/unpack"
+	"github.com/nwaples/rardecode/v2"
 )
 
 func symlink(t *testing.T, oldname, newname string) {
@@ -83,11 +94,12 @@ func TestHandle(t *testing.T) {
 		for _, tt := range tests {
 			os.Remove(tt.file)
 		}
+		os.Remove(filepath.Join(td, manifest.Filename))
 	}()
 
 	// Trigger unpacking by passing in a file contained in testdata
-	h := NewHandler()
-	if err := h.Handle(tests[0].file, "", false); err != nil {
+	h := NewHandler(Options{})
+	if err := h.Handle(context.Background(), tests[0].file, "", false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -129,23 +141,689 @@ func TestHandleIncomplete(t *testing.T) {
 	symlink(t, realRAR1, rar1)
 	symlink(t, realRAR2, rar2)
 
-	h := NewHandler()
+	h := NewHandler(Options{})
 
 	// Verified checksums are cached while RAR set is incomplete
 	want := "incomplete: " + tempdir + ": 2/3 files"
-	if err := h.Handle(rar1, "", true); err.Error() != want {
+	if err := h.Handle(context.Background(), rar1, "", true); err.Error() != want {
 		t.Errorf("want err = %q, got %q", want, err.Error())
 	}
-	if want, got := 2, len(h.cache); want != got {
+	if want, got := 2, h.cache.Len(); want != got {
 		t.Errorf("want len = %d, got %d", want, got)
 	}
 
 	// Completing the set clears cache
 	symlink(t, realRAR3, rar3)
-	if err := h.Handle(rar3, "", true); err != nil {
+	if err := h.Handle(context.Background(), rar3, "", true); err != nil {
 		t.Fatal(err)
 	}
-	if want, got := 0, len(h.cache); want != got {
+	if want, got := 0, h.cache.Len(); want != got {
 		t.Errorf("want %d cache entries, got %d", want, got)
 	}
 }
+
+func TestUnpackUnsafe(t *testing.T) {
+	td := filepath.Join(testDir(t), "unsafe")
+	var tests = []struct {
+		archive string
+		err     string
+	}{
+		{"traversal.rar", "unsafe entry: path traversal: ../evil"},
+		{"absolute.rar", "unsafe entry: absolute path: /evil"},
+		{"symlink.rar", "unsafe entry: evil: symlink target outside "},
+	}
+	for i, tt := range tests {
+		for _, skip := range []bool{false, true} {
+			root := t.TempDir()
+			dir := filepath.Join(root, "a", "b")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(dir, tt.archive)
+			symlink(t, filepath.Join(td, tt.archive), archive)
+
+			h := NewHandler(Options{Options: unpack.Options{SkipUnsafe: skip, Symlinks: true}})
+			_, err := h.unpack(context.Background(), archive, dir, dir, 0)
+			if skip {
+				if err != nil {
+					t.Fatalf("#%d: %s", i, err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "ok")); err != nil {
+					t.Errorf("#%d: want safe entry to be unpacked: %s", i, err)
+				}
+			} else if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+			}
+			for _, name := range []string{filepath.Join(root, "a", "evil"), filepath.Join(dir, "evil"), "/evil"} {
+				if _, err := os.Lstat(name); err == nil {
+					t.Errorf("#%d: unsafe entry unpacked to %s", i, name)
+				}
+			}
+		}
+	}
+}
+
+func TestUnpackSymlinkAsFile(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "symlink.rar")
+	symlink(t, filepath.Join(testDir(t), "unsafe", "symlink.rar"), archive)
+	// Without Symlinks, the target is only written as file contents, so it is not checked
+	if _, err := NewHandler(Options{}).unpack(context.Background(), archive, dir, dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "evil"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Errorf("want regular file, got mode %s", fi.Mode())
+	}
+}
+
+func TestHandleDestDir(t *testing.T) {
+	var (
+		td   = testDir(t)
+		src  = filepath.Join(t.TempDir(), "src")
+		dest = filepath.Join(t.TempDir(), "unpacked")
+	)
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test.rar", "test.r00", "test.r01", "test.sfv"} {
+		symlink(t, filepath.Join(td, name), filepath.Join(src, name))
+	}
+
+	h := NewHandler(Options{Options: unpack.Options{DestDir: dest + "/{{.Base}}"}})
+	if err := h.Handle(context.Background(), filepath.Join(src, "test.rar"), "", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test1", "test2", "test3", filepath.Join("test", "test4")} {
+		if _, err := os.Stat(filepath.Join(dest, "test.rar", name)); err != nil {
+			t.Error(err)
+		}
+		if _, err := os.Stat(filepath.Join(src, name)); err == nil {
+			t.Errorf("want %s to be unpacked to destination only", name)
+		}
+	}
+}
+
+func TestHandleProgress(t *testing.T) {
+	var (
+		td   = testDir(t)
+		src  = filepath.Join(t.TempDir(), "src")
+		dest = filepath.Join(t.TempDir(), "unpacked")
+	)
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test.rar", "test.r00", "test.r01", "test.sfv"} {
+		symlink(t, filepath.Join(td, name), filepath.Join(src, name))
+	}
+
+	var reports []progress.Progress
+	ctx := progress.WithFunc(context.Background(), func(p progress.Progress) { reports = append(reports, p) })
+	h := NewHandler(Options{Options: unpack.Options{DestDir: dest}})
+	if err := h.Handle(ctx, filepath.Join(src, "test.rar"), "", false); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]bool)
+	var last progress.Progress
+	for _, p := range reports {
+		if p.Name == filepath.Join(src, "test.rar") {
+			entries[p.Entry] = true
+			last = p
+		}
+	}
+	for _, name := range []string{"test1", "test2", "nested.rar", "test/test4"} {
+		if !entries[name] {
+			t.Errorf("want progress for entry %s", name)
+		}
+	}
+	if last.Total == 0 || last.Done != last.Total {
+		t.Errorf("want done = total, got %d/%d", last.Done, last.Total)
+	}
+}
+
+func TestHandleMultipleSets(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+	)
+	for _, name := range []string{"test.rar", "test.r00", "test.r01", "test.sfv"} {
+		symlink(t, filepath.Join(td, name), filepath.Join(dir, name))
+	}
+	// Second set with its own SFV
+	data, err := os.ReadFile(filepath.Join(td, "nested", "nested.rar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "subs.rar"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sfvData := fmt.Sprintf("subs.rar %08x\n", crc32.ChecksumIEEE(data))
+	if err := os.WriteFile(filepath.Join(dir, "subs.sfv"), []byte(sfvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Options{})
+	if err := h.Handle(context.Background(), filepath.Join(dir, "subs.rar"), "", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old", "test.rar", "test.r00", "test.r01", "test.sfv"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("want %s to exist", name)
+		}
+	}
+	for _, name := range []string{"test1", "subs.rar", "subs.sfv"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("want %s to not exist", name)
+		}
+	}
+
+	// Volumes other than the first one belong to their set
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.r01"), "", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test1", "test2", "test3"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("want %s to exist", name)
+		}
+	}
+	for _, name := range []string{"test.rar", "test.r00", "test.r01", "test.sfv"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("want %s to not exist", name)
+		}
+	}
+}
+
+func TestSFVFor(t *testing.T) {
+	a := &sfv.SFV{Path: "/d/a.sfv", Checksums: []sfv.Checksum{{Path: "/d/a.rar"}, {Path: "/d/a.r00"}}}
+	b := &sfv.SFV{Path: "/d/b.sfv", Checksums: []sfv.Checksum{{Path: "/d/b.part1.rar"}, {Path: "/d/b.nfo"}}}
+	var tests = []struct {
+		sfvs []*sfv.SFV
+		in   string
+		out  *sfv.SFV
+	}{
+		{[]*sfv.SFV{a, b}, "/d/a.sfv", a},
+		{[]*sfv.SFV{a, b}, "/d/b.sfv", b},
+		{[]*sfv.SFV{a, b}, "/d/a.r00", a},
+		{[]*sfv.SFV{a, b}, "/d/a.r01", a},
+		{[]*sfv.SFV{a, b}, "/d/b.part2.rar", b},
+		{[]*sfv.SFV{a, b}, "/d/b.nfo", b},
+		{[]*sfv.SFV{a, b}, "/d/c.rar", nil},
+		{[]*sfv.SFV{a, b}, "/d/foo", nil},
+		{[]*sfv.SFV{a}, "/d/foo", a},
+		{[]*sfv.SFV{a}, "/d/c.rar", nil},
+		{nil, "/d/a.rar", nil},
+	}
+	for i, tt := range tests {
+		if got := sfvFor(tt.in, tt.sfvs); got != tt.out {
+			t.Errorf("#%d: want %v, got %v for %s", i, tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestHandleInsufficientSpace(t *testing.T) {
+	var (
+		td   = testDir(t)
+		src  = filepath.Join(t.TempDir(), "src")
+		dest = filepath.Join(t.TempDir(), "unpacked")
+	)
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test.rar", "test.r00", "test.r01", "test.sfv"} {
+		symlink(t, filepath.Join(td, name), filepath.Join(src, name))
+	}
+
+	h := NewHandler(Options{Options: unpack.Options{DestDir: dest, ReserveSpace: math.MaxInt64 / 2}})
+	err := h.Handle(context.Background(), filepath.Join(src, "test.rar"), "", false)
+	if !errors.Is(err, fsutil.ErrInsufficientSpace) {
+		t.Fatalf("want %q, got %v", fsutil.ErrInsufficientSpace, err)
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("want empty destination, got %d entries", len(entries))
+	}
+}
+
+func TestUnpackedSize(t *testing.T) {
+	size, err := unpackedSize(filepath.Join(testDir(t), "test.rar"), func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size <= 0 {
+		t.Errorf("want positive size, got %d", size)
+	}
+}
+
+func TestHandleUnpackFailure(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		archive = filepath.Join(dir, "traversal.rar")
+	)
+	data, err := os.ReadFile(filepath.Join(testDir(t), "unsafe", "traversal.rar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archive, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sfvData := fmt.Sprintf("traversal.rar %08x\n", crc32.ChecksumIEEE(data))
+	if err := os.WriteFile(filepath.Join(dir, "traversal.sfv"), []byte(sfvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries unpacked before the failing one are not published
+	h := NewHandler(Options{})
+	if err := h.Handle(context.Background(), archive, "", false); err == nil {
+		t.Fatal("want error")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(entries); want != got {
+		t.Errorf("want %d files in %s, got %d", want, dir, got)
+	}
+}
+
+func TestUnpackCancel(t *testing.T) {
+	dest := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h := NewHandler(Options{})
+	_, err := h.unpackTo(ctx, filepath.Join(testDir(t), "test.rar"), dest)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %q, got %v", context.Canceled, err)
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("want partial output to be removed, got %d entries", len(entries))
+	}
+}
+
+func TestReadHeaders(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.rar")
+	var tests = []struct {
+		errs  []error
+		calls int
+		err   error
+	}{
+		{[]error{nil}, 1, nil},
+		{[]error{rardecode.ErrShortFile}, 1, rardecode.ErrShortFile},
+		{[]error{rardecode.ErrArchiveEncrypted, rardecode.ErrBadHeaderCRC, nil}, 3, nil},
+		{[]error{rardecode.ErrArchiveEncrypted, rardecode.ErrBadPassword, os.ErrNotExist}, 3, os.ErrNotExist},
+		{[]error{rardecode.ErrArchiveEncrypted, rardecode.ErrBadHeaderCRC, rardecode.ErrCorruptFileHeader, rardecode.ErrBadPassword}, 4, rardecode.ErrArchiveEncrypted},
+	}
+	for i, tt := range tests {
+		h := NewHandler(Options{Options: unpack.Options{Passwords: []string{"a", "b", "c"}}})
+		calls := 0
+		err := h.readHeaders(name, func(opts ...rardecode.Option) error {
+			calls++
+			if len(opts) != min(calls-1, 1) {
+				t.Errorf("#%d: want password option for call %d", i, calls)
+			}
+			return tt.errs[calls-1]
+		})
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("#%d: want %v, got %v", i, tt.err, err)
+		}
+		if calls != tt.calls {
+			t.Errorf("#%d: want %d calls, got %d", i, tt.calls, calls)
+		}
+	}
+}
+
+func TestExtractEncrypted(t *testing.T) {
+	archive := filepath.Join(testDir(t), "encrypted", "encrypted.rar")
+	passwords := filepath.Join(t.TempDir(), "passwords")
+	if err := os.WriteFile(passwords, []byte("hunter2\r\n\r\nwrong2\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		opts    Options
+		sidecar string
+		err     string
+	}{
+		{Options{}, "", "archive is encrypted and no password worked: %s: tried 0 password(s)"},
+		{Options{Options: unpack.Options{Passwords: []string{"hunter2", "wrong1"}}}, "", ""},
+		{Options{Options: unpack.Options{PasswordFile: passwords}}, "", ""},
+		{Options{Options: unpack.Options{Passwords: []string{"wrong1"}}}, "hunter2\n", ""},
+		// RAR 4 archives have no password check, so a checksum error of an encrypted entry tries the next password
+		{Options{Options: unpack.Options{Passwords: []string{"wrong1", "hunter2"}}}, "", ""},
+		{Options{Options: unpack.Options{Passwords: []string{"wrong1", "wrong2"}}}, "", "archive is encrypted and no password worked: %s: tried 2 password(s)"},
+	}
+	for i, tt := range tests {
+		dir := t.TempDir()
+		name := filepath.Join(dir, filepath.Base(archive))
+		symlink(t, archive, name)
+		if tt.sidecar != "" {
+			if err := os.WriteFile(filepath.Join(dir, unpack.PasswordFile), []byte(tt.sidecar), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dest := t.TempDir()
+		h := NewHandler(tt.opts)
+		_, err := h.extract(context.Background(), name, dest)
+		if tt.err != "" {
+			want := strings.ReplaceAll(tt.err, "%s", name)
+			if err == nil || err.Error() != want {
+				t.Errorf("#%d: want err = %q, got %v", i, want, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dest, "secret"))
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if want, got := "secret\n", string(data); want != got {
+			t.Errorf("#%d: want %q, got %q", i, want, got)
+		}
+		entries, err := os.ReadDir(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := 1, len(entries); want != got {
+			t.Errorf("#%d: want %d files in %s, got %d", i, want, dest, got)
+		}
+	}
+}
+
+func TestHandleHeaders(t *testing.T) {
+	for _, completeness := range []string{CompletenessHeaders, CompletenessAuto} {
+		var (
+			td   = testDir(t)
+			dir  = t.TempDir()
+			rar1 = filepath.Join(dir, "test.rar")
+			rar2 = filepath.Join(dir, "test.r00")
+			rar3 = filepath.Join(dir, "test.r01")
+		)
+		symlink(t, filepath.Join(td, "test.rar"), rar1)
+		symlink(t, filepath.Join(td, "test.r00"), rar2)
+
+		h := NewHandler(Options{Completeness: completeness})
+		if err := h.Handle(context.Background(), rar2, "", true); err == nil || !strings.HasPrefix(err.Error(), "incomplete: "+dir) {
+			t.Errorf("want incomplete error, got %v", err)
+		}
+
+		symlink(t, filepath.Join(td, "test.r01"), rar3)
+		if err := h.Handle(context.Background(), rar3, "", true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "test1")); err != nil {
+			t.Error(err)
+		}
+		for _, name := range []string{rar1, rar2, rar3} {
+			if _, err := os.Lstat(name); !os.IsNotExist(err) {
+				t.Errorf("want %s to be removed", name)
+			}
+		}
+	}
+}
+
+func TestHandleChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "corrupt.rar")
+	symlink(t, filepath.Join(testDir(t), "corrupt", "corrupt.rar"), archive)
+
+	h := NewHandler(Options{Completeness: CompletenessHeaders})
+	want := "unpacking failed: " + dir + ": checksum mismatch: bad: rardecode: bad file checksum"
+	if err := h.Handle(context.Background(), archive, "", true); err == nil || err.Error() != want {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+	// Nothing is published and the archive is kept
+	if _, err := os.Lstat(archive); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "good")); !os.IsNotExist(err) {
+		t.Errorf("want good entry to not be published when set is corrupt")
+	}
+}
+
+func TestHandleOverwrite(t *testing.T) {
+	var (
+		old = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		now = time.Now()
+	)
+	var tests = []struct {
+		policy  string
+		mtime   time.Time
+		want    map[string]int64
+		wantErr bool
+	}{
+		{fsutil.OverwriteAlways, now, map[string]int64{"test1": 512}, false},
+		{fsutil.OverwriteNever, old, map[string]int64{"test1": 8}, false},
+		{fsutil.OverwriteIfNewer, old, map[string]int64{"test1": 512}, false},
+		{fsutil.OverwriteIfNewer, now, map[string]int64{"test1": 8}, false},
+		{fsutil.OverwriteRename, now, map[string]int64{"test1": 8, "test1.1": 512}, false},
+		{fsutil.OverwriteFail, now, map[string]int64{"test1": 8}, true},
+	}
+	td := testDir(t)
+	for i, tt := range tests {
+		dir := t.TempDir()
+		for _, name := range []string{"test.rar", "test.r00", "test.r01", "test.sfv"} {
+			symlink(t, filepath.Join(td, name), filepath.Join(dir, name))
+		}
+		existing := filepath.Join(dir, "test1")
+		if err := os.WriteFile(existing, []byte("existing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(existing, tt.mtime, tt.mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		h := NewHandler(Options{Options: unpack.Options{Overwrite: tt.policy}})
+		err := h.Handle(context.Background(), filepath.Join(dir, "test.rar"), "", false)
+		if tt.wantErr != (err != nil) {
+			t.Errorf("#%d: want error = %t, got %v", i, tt.wantErr, err)
+		}
+		for name, size := range tt.want {
+			fi, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Errorf("#%d: %s", i, err)
+				continue
+			}
+			if fi.Size() != size {
+				t.Errorf("#%d: want size %d, got %d for %s", i, size, fi.Size(), name)
+			}
+		}
+	}
+}
+
+func TestUnpackLinksAndModes(t *testing.T) {
+	archive := filepath.Join(testDir(t), "links", "links.rar")
+
+	// Links and modes are restored when enabled
+	dir := t.TempDir()
+	h := NewHandler(Options{Options: unpack.Options{PreserveMode: true, Symlinks: true}, HardLinks: true})
+	if _, err := h.unpack(context.Background(), archive, dir, dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"dir", os.ModeDir | 0700},
+		{filepath.Join("dir", "exec"), 0750},
+		{filepath.Join("dir", "hardlink"), 0750},
+		{"readonly", 0444},
+	}
+	for _, tt := range tests {
+		fi, err := os.Lstat(filepath.Join(dir, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode(); got != tt.mode {
+			t.Errorf("want mode %s, got %s for %s", tt.mode, got, tt.name)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(dir, "dir", "symlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "exec"; target != want {
+		t.Errorf("want symlink target %q, got %q", want, target)
+	}
+	fi1, err := os.Stat(filepath.Join(dir, "dir", "exec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(filepath.Join(dir, "dir", "hardlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Errorf("want %s to be a hard link", fi2.Name())
+	}
+
+	// Links are unpacked as regular files when disabled
+	dir = t.TempDir()
+	h = NewHandler(Options{})
+	if _, err := h.unpack(context.Background(), archive, dir, dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"symlink", "hardlink"} {
+		fi, err := os.Lstat(filepath.Join(dir, "dir", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("want %s to be a regular file, got mode %s", name, fi.Mode())
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dir", "symlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "exec", string(data); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestUnpackNested(t *testing.T) {
+	archive := filepath.Join(testDir(t), "nested", "nested.rar")
+	var tests = []struct {
+		opts    Options
+		exist   []string
+		missing []string
+	}{
+		{Options{},
+			[]string{"old", "old.rar", "old.r00", filepath.Join("inner", "new"), filepath.Join("inner", "new.part2.rar"), "deeper.rar", "deepest"},
+			nil},
+		{Options{Options: unpack.Options{RemoveNested: true}},
+			[]string{"old", filepath.Join("inner", "new"), "deepest"},
+			[]string{"old.rar", "old.r00", filepath.Join("inner", "new.part1.rar"), filepath.Join("inner", "new.part3.rar"), "deep.rar", "deeper.rar"}},
+		{Options{Options: unpack.Options{MaxNesting: 1}},
+			[]string{"old", filepath.Join("inner", "new"), "deeper.rar"},
+			[]string{"deepest"}},
+		{Options{Options: unpack.Options{MaxNesting: -1}},
+			[]string{"old.rar", "old.r00", "deep.rar"},
+			[]string{"old", filepath.Join("inner", "new"), "deeper.rar"}},
+	}
+	for i, tt := range tests {
+		dir := t.TempDir()
+		h := NewHandler(tt.opts)
+		if _, err := h.unpack(context.Background(), archive, dir, dir, 0); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		for _, name := range tt.exist {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("#%d: want %s to exist", i, name)
+			}
+		}
+		for _, name := range tt.missing {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				t.Errorf("#%d: want %s to not exist", i, name)
+			}
+		}
+	}
+}
+
+func TestUnpackFilters(t *testing.T) {
+	archive := filepath.Join(testDir(t), "test.rar")
+	var tests = []struct {
+		opts    Options
+		exist   []string
+		missing []string
+	}{
+		{Options{Options: unpack.Options{ExtractExclude: []string{"test/", "test2"}}},
+			[]string{"test1", "nested.rar", "test3"},
+			[]string{"test2", "test"}},
+		{Options{Options: unpack.Options{ExtractInclude: []string{"test1"}}},
+			[]string{"test1", "nested.rar"},
+			[]string{"test2", "test3", "test"}},
+		{Options{Options: unpack.Options{ExtractInclude: []string{"test1"}, MaxNesting: -1}},
+			[]string{"test1"},
+			[]string{"test2", "nested.rar", "test"}},
+		{Options{Options: unpack.Options{ExtractInclude: []string{"test/**"}}},
+			[]string{filepath.Join("test", "test4")},
+			[]string{"test1", "test2"}},
+	}
+	for i, tt := range tests {
+		dir := t.TempDir()
+		h := NewHandler(tt.opts)
+		if _, err := h.unpack(context.Background(), archive, dir, dir, 0); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		for _, name := range tt.exist {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("#%d: want %s to exist", i, name)
+			}
+		}
+		for _, name := range tt.missing {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				t.Errorf("#%d: want %s to not exist", i, name)
+			}
+		}
+	}
+}
+
+func TestHandleRepair(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+	)
+	for _, name := range []string{"test.rar", "test.r01", "test.sfv"} {
+		symlink(t, filepath.Join(td, name), filepath.Join(dir, name))
+	}
+	for _, name := range []string{"test.par2", "test.vol00+02.par2"} {
+		symlink(t, filepath.Join(td, "par2", name), filepath.Join(dir, name))
+	}
+	// Damage one volume
+	data, err := os.ReadFile(filepath.Join(td, "test.r00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[100] ^= 0xff
+	r00 := filepath.Join(dir, "test.r00")
+	if err := os.WriteFile(r00, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "incomplete: " + dir + ": 2/3 files"
+	if err := NewHandler(Options{}).Handle(context.Background(), r00, "", false); err == nil || err.Error() != want {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+	// Repair waits until the files of the set have stopped changing
+	if err := NewHandler(Options{Par2: true, Par2Delay: time.Hour}).Handle(context.Background(), r00, "", false); !errors.Is(err, fsutil.ErrChanging) {
+		t.Errorf("want %q, got %v", fsutil.ErrChanging, err)
+	}
+	if err := NewHandler(Options{Par2: true}).Handle(context.Background(), r00, "", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test1", "test2", "test3", filepath.Join("test", "test4")} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package rar
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+const (
+	// CompletenessSFV determines completeness of a RAR set from its SFV file.
+	CompletenessSFV = "sfv"
+	// CompletenessHeaders determines completeness of a RAR set from its volume headers.
+	CompletenessHeaders = "headers"
+	// CompletenessAuto uses CompletenessSFV if a SFV file exists, and CompletenessHeaders otherwise.
+	CompletenessAuto = "auto"
+)
+
+var (
+	rarNewVolumeRE = regexp.MustCompile(`\.part(\d+)\.rar$`)
+	rarOldVolumeRE = regexp.MustCompile(`\.(rar|[rs]\d\d)$`)
+)
+
+// firstVolume returns the name of the first volume in the RAR set that the volume name belongs to.
+func firstVolume(name string) (string, error) {
+	if m := rarNewVolumeRE.FindStringSubmatchIndex(name); m != nil {
+		lo, hi := m[2], m[3]
+		return name[:lo] + fmt.Sprintf("%0*d", hi-lo, 1) + name[hi:], nil
+	}
+	if m := rarOldVolumeRE.FindStringIndex(name); m != nil {
+		return name[:m[0]] + ".rar", nil
+	}
+	return "", fmt.Errorf("not a rar volume: %s", name)
+}
+
+// volumeName returns the name of volume n, counting from zero, in the RAR set starting with the volume first.
+func volumeName(first string, n int) string {
+	if m := rarNewVolumeRE.FindStringSubmatchIndex(first); m != nil {
+		lo, hi := m[2], m[3]
+		return first[:lo] + fmt.Sprintf("%0*d", hi-lo, n+1) + first[hi:]
+	}
+	if n == 0 {
+		return first
+	}
+	ext := string(rune('r'+(n-1)/100)) + fmt.Sprintf("%02d", (n-1)%100)
+	return first[:len(first)-len("rar")] + ext
+}
+
+// readVolumes reads all headers in the RAR set starting with the volume first, and returns the path of every volume
+// in the set. An error is returned if any volume is missing, truncated or out of sequence.
+func readVolumes(first string, opts ...rardecode.Option) ([]string, error) {
+	r, err := rardecode.OpenReader(first, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for {
+		// Skipping over file contents only reads headers, but requires every volume to be present
+		_, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	dir := filepath.Dir(first)
+	var volumes []string
+	for i, name := range r.Volumes() {
+		want := volumeName(filepath.Base(first), i)
+		if filepath.Base(name) != want {
+			return nil, fmt.Errorf("volume %d is %s, want %s", i+1, filepath.Base(name), want)
+		}
+		volumes = append(volumes, filepath.Join(dir, want))
+	}
+	return volumes, nil
+}
+
+// unpackedSize returns the total unpacked size of all files in the RAR set starting with the volume first. Files for
+// which skip returns true are not counted.
+func unpackedSize(first string, skip func(name string) bool, opts ...rardecode.Option) (int64, error) {
+	r, err := rardecode.OpenReader(first, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	var size int64
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !header.UnKnownSize && !skip(header.Name) {
+			size += header.UnPackedSize
+		}
+	}
+	return size, nil
+}
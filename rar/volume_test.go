@@ -0,0 +1,84 @@
+package rar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFirstVolume(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"foo.rar", "foo.rar"},
+		{"foo.r00", "foo.rar"},
+		{"foo.r42", "foo.rar"},
+		{"foo.s01", "foo.rar"},
+		{"foo.part1.rar", "foo.part1.rar"},
+		{"foo.part7.rar", "foo.part1.rar"},
+		{"foo.part07.rar", "foo.part01.rar"},
+		{"foo.part123.rar", "foo.part001.rar"},
+		{"foo.sfv", ""},
+		{"foo.nfo", ""},
+	}
+	for _, tt := range tests {
+		got, err := firstVolume(tt.in)
+		if tt.out == "" {
+			if err == nil {
+				t.Errorf("want error for %s", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.out {
+			t.Errorf("want %s, got %s", tt.out, got)
+		}
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	var tests = []struct {
+		first string
+		n     int
+		out   string
+	}{
+		{"foo.rar", 0, "foo.rar"},
+		{"foo.rar", 1, "foo.r00"},
+		{"foo.rar", 100, "foo.r99"},
+		{"foo.rar", 101, "foo.s00"},
+		{"foo.part1.rar", 0, "foo.part1.rar"},
+		{"foo.part1.rar", 9, "foo.part10.rar"},
+		{"foo.part01.rar", 2, "foo.part03.rar"},
+	}
+	for _, tt := range tests {
+		if got := volumeName(tt.first, tt.n); got != tt.out {
+			t.Errorf("want %s, got %s for %s #%d", tt.out, got, tt.first, tt.n)
+		}
+	}
+}
+
+func TestReadVolumes(t *testing.T) {
+	td := testDir(t)
+	dir := t.TempDir()
+	first := filepath.Join(dir, "test.rar")
+	symlink(t, filepath.Join(td, "test.rar"), first)
+	symlink(t, filepath.Join(td, "test.r00"), filepath.Join(dir, "test.r00"))
+
+	if _, err := readVolumes(first); err == nil || !os.IsNotExist(err) {
+		t.Errorf("want not exist error, got %v", err)
+	}
+
+	symlink(t, filepath.Join(td, "test.r01"), filepath.Join(dir, "test.r01"))
+	volumes, err := readVolumes(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{first, filepath.Join(dir, "test.r00"), filepath.Join(dir, "test.r01")}
+	if got := strings.Join(volumes, ","); got != strings.Join(want, ",") {
+		t.Errorf("want %s, got %s", want, volumes)
+	}
+}
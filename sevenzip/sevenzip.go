@@ -0,0 +1,443 @@
+package sevenzip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/mpolden/sfv"
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/pathutil"
+	"github.com/mpolden/unp/progress"
+	"github.com/mpolden/unp/sfvutil"
+	"github.com/mpolden/unp/syncutil"
+	"github.com/mpolden/unp/unpack"
+)
+
+var (
+	// errChecksum is returned when the contents of an entry do not match the CRC32 stored in the archive.
+	errChecksum = errors.New("checksum mismatch")
+	// errEncryptedEntry is returned along with errChecksum when the entry is encrypted, in which case the mismatch is
+	// likely caused by a wrong password.
+	errEncryptedEntry = errors.New("encrypted entry")
+)
+
+// Options configures how a Handler unpacks archives.
+type Options struct {
+	unpack.Options
+	unpack.VerifyOptions
+}
+
+// Handler unpacks 7z archives, including multi-volume sets.
+type Handler struct {
+	locks syncutil.KeyMutex
+	cache *sfvutil.Cache
+	opts  Options
+}
+
+func find7z(s *sfv.SFV) (string, error) {
+	for _, c := range s.Checksums {
+		if first, err := firstVolume(c.Path); err == nil {
+			return first, nil
+		}
+	}
+	return "", fmt.Errorf("no 7z found in %s", s.Path)
+}
+
+// eventFrom returns the set that filename belongs to. The set is described by a SFV if one lists it, and by the 7z
+// headers otherwise.
+func eventFrom(filename string) (unpack.Set, error) {
+	dir := filepath.Dir(filename)
+	sfvs, err := sfvutil.ReadDir(dir)
+	if err != nil {
+		return unpack.Set{}, err
+	}
+	var first string
+	s := sfvutil.Find(filename, sfvs, firstVolume)
+	if s != nil {
+		first, err = find7z(s)
+	} else {
+		first, err = firstVolume(filename)
+	}
+	if err != nil {
+		return unpack.Set{}, err
+	}
+	return unpack.Set{
+		SFV:  s,
+		Base: filepath.Base(first),
+		Dir:  dir,
+		Name: first,
+	}, nil
+}
+
+func NewHandler(opts Options) *Handler {
+	return &Handler{cache: opts.LoadCache(), opts: opts}
+}
+
+// Close stops pruning the verification cache of the handler.
+func (h *Handler) Close() { h.cache.Close() }
+
+// skip returns whether the entry name should be skipped. See unpack.Options.SkipNested.
+func (h *Handler) skip(name string) bool { return h.opts.SkipNested(name, firstVolume) }
+
+// isEncrypted returns whether err is caused by reading encrypted data, which may be fixed by trying another password.
+func isEncrypted(err error) bool {
+	var rerr *sevenzip.ReadError
+	return errors.As(err, &rerr) && rerr.Encrypted
+}
+
+func isPasswordError(err error) bool { return isEncrypted(err) || errors.Is(err, errEncryptedEntry) }
+
+// isEncryptedEntry returns whether the contents of the entry name in the 7z set starting with the volume first are
+// encrypted. Encrypted contents decode differently with different passwords, while other contents decode the same.
+func isEncryptedEntry(first, name string) bool {
+	var heads [][]byte
+	for _, password := range []string{"a", "b"} {
+		head, err := readHead(first, name, password)
+		if err != nil {
+			return isEncrypted(err)
+		}
+		heads = append(heads, head)
+	}
+	return !bytes.Equal(heads[0], heads[1])
+}
+
+// readHead reads the first bytes of the entry name in the 7z set starting with the volume first.
+func readHead(first, name, password string) ([]byte, error) {
+	r, err := openReader(first, password)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name == name {
+			return readEntry(f, 64)
+		}
+	}
+	return nil, fmt.Errorf("entry not found: %s", name)
+}
+
+// openReader opens the 7z set starting with the volume first. The 7z library panics on some corrupt headers, so a
+// panic is returned as an error instead.
+func openReader(first, password string) (r *sevenzip.ReadCloser, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			r, err = nil, fmt.Errorf("corrupt headers: %s: %v", first, v)
+		}
+	}()
+	return sevenzip.OpenReaderWithPassword(first, password)
+}
+
+// readHeaders reads the headers of the 7z set starting with the volume first. An error is returned if any volume is
+// missing or truncated. Encrypted headers cannot be read without a password, but their presence is enough to show that
+// the set is complete.
+func readHeaders(first string) error {
+	r, err := openReader(first, "")
+	if isEncrypted(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+// unpackedSize returns the total size of the entries in the 7z set starting with the volume first that are not
+// skipped.
+func (h *Handler) unpackedSize(first, password string) (int64, error) {
+	r, err := openReader(first, password)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	var size int64
+	for _, f := range r.File {
+		if !h.skip(f.Name) {
+			size += int64(f.UncompressedSize)
+		}
+	}
+	return size, nil
+}
+
+// copyEntry copies the contents of f from r to w. Contents are hashed while being copied, and compared to the CRC32
+// stored in the archive once the end of the entry is reached, unless the archive stores no CRC32 for the entry. The
+// number of bytes copied and their CRC32 is returned.
+func copyEntry(ctx context.Context, w io.Writer, r io.Reader, f *sevenzip.File) (int64, uint32, error) {
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, hash), unpack.Reader(ctx, r))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+	}
+	if n != int64(f.UncompressedSize) {
+		return 0, 0, fmt.Errorf("size mismatch: %s: want %d bytes, got %d", f.Name, f.UncompressedSize, n)
+	}
+	if crc := hash.Sum32(); n > 0 && f.CRC32 != 0 && crc != f.CRC32 {
+		return 0, 0, fmt.Errorf("%w: %s", errChecksum, f.Name)
+	}
+	return n, hash.Sum32(), nil
+}
+
+func isSymlink(f *sevenzip.File) bool { return f.Mode()&fs.ModeSymlink != 0 }
+
+// hasUnixMode returns whether f stores Unix permission bits, as archives created on Unix systems do.
+func hasUnixMode(f *sevenzip.File) bool { return f.Attributes&0xf0000000 != 0 }
+
+// chmod sets the permission bits of name to the ones stored in f, if f was created on a Unix system. Directories
+// always remain accessible to their owner, so that they can be written to and published.
+func chmod(name string, f *sevenzip.File) error {
+	if !hasUnixMode(f) {
+		return nil
+	}
+	mode := f.Mode().Perm()
+	if f.FileInfo().IsDir() {
+		mode |= 0700
+	}
+	return os.Chmod(name, mode)
+}
+
+func chtimes(name string, f *sevenzip.File) error {
+	if f.Modified.IsZero() {
+		return nil
+	}
+	return os.Chtimes(name, f.Modified, f.Modified)
+}
+
+// readEntry reads the contents of f, up to limit bytes.
+func readEntry(f *sevenzip.File, limit int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, limit))
+}
+
+// unpackFile unpacks the contents of f to name.
+func unpackFile(ctx context.Context, f *sevenzip.File, name string) (int64, uint32, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+	out, err := os.Create(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create file: %s: %w", name, err)
+	}
+	n, crc, err := copyEntry(ctx, out, rc, f)
+	if err != nil {
+		out.Close()
+		return 0, 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, 0, err
+	}
+	return n, crc, nil
+}
+
+// unpack unpacks the 7z set starting with the volume filename to dir. Existing files in dest, which is the directory
+// that dir is eventually published to, are handled according to the overwrite policy. Depth is the nesting depth of
+// filename. The regular files that were unpacked are returned, relative to dir.
+func (h *Handler) unpack(ctx context.Context, filename, dir, dest string, depth int, password string) ([]manifest.Entry, error) {
+	r, err := openReader(filename, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer r.Close()
+	var volumes []string
+	var files []manifest.Entry
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if h.skip(f.Name) {
+			continue
+		}
+		name, err := pathutil.Join(dir, f.Name)
+		if err != nil {
+			if err := h.opts.Unsafe(filename, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// If entry is a directory, create it and set correct ctime
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return nil, err
+			}
+			if h.opts.PreserveMode {
+				if err := chmod(name, f); err != nil {
+					return nil, err
+				}
+			}
+			if err := chtimes(name, f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var symlinkTo string
+		// Without Symlinks, the link target is unpacked as file contents, which is safe wherever it points
+		if isSymlink(f) && h.opts.Symlinks {
+			// Symbolic links store their target as the file contents
+			target, err := readEntry(f, unpack.MaxLinkSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+			}
+			if err := unpack.CheckSymlink(dir, name, string(target)); err != nil {
+				if err := h.opts.Unsafe(filename, fmt.Errorf("%s: %w", f.Name, err)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			symlinkTo = string(target)
+		}
+		name, err = h.opts.Target(dir, dest, name, f.Name, f.Modified)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		if symlinkTo != "" {
+			if err := unpack.Link(name, symlinkTo, ""); err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+			}
+			continue
+		}
+		// Unpack file
+		progress.SetEntry(ctx, f.Name)
+		n, crc, err := unpackFile(ctx, f, name)
+		if errors.Is(err, errChecksum) && isEncryptedEntry(filename, f.Name) {
+			return nil, fmt.Errorf("%w: %w", errEncryptedEntry, err)
+		} else if err != nil {
+			return nil, err
+		}
+		if h.opts.PreserveMode {
+			if err := chmod(name, f); err != nil {
+				return nil, err
+			}
+		}
+		// Set correct ctime of unpacked file
+		if err := chtimes(name, f); err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, manifest.Entry{Name: filepath.ToSlash(rel), Size: n, CRC32: fmt.Sprintf("%08x", crc)})
+		if _, err := firstVolume(name); err == nil {
+			volumes = append(volumes, name)
+		}
+	}
+	return h.opts.UnpackNested(ctx, dir, dest, depth, files, volumes, firstVolume,
+		func(ctx context.Context, first, dest string, depth int) ([]manifest.Entry, error) {
+			size, _ := h.unpackedSize(first, password)
+			ctx = progress.Start(ctx, filepath.Join(dest, filepath.Base(first)), size)
+			return h.unpack(ctx, first, filepath.Dir(first), dest, depth, password)
+		})
+}
+
+// unpackTo unpacks filename into a staging directory, and publishes the staged files to dest if successful.
+func (h *Handler) unpackTo(ctx context.Context, filename, dest, password string) ([]manifest.Entry, error) {
+	return h.opts.Staged(dest, func(dir string) ([]manifest.Entry, error) {
+		return h.unpack(ctx, filename, dir, dest, 0, password)
+	})
+}
+
+// checkSpace returns the unpacked size of filename, and an error if dest does not have room for it. The returned size
+// is zero if it cannot be known before unpacking.
+func (h *Handler) checkSpace(filename, dest string) (int64, error) {
+	size, err := h.unpackedSize(filename, "")
+	if isEncrypted(err) {
+		return 0, nil // Headers are encrypted, so the size is unknown until unpacking
+	} else if err != nil {
+		return 0, err
+	}
+	return size, fsutil.CheckSpace(dest, size, h.opts.ReserveSpace)
+}
+
+// extract unpacks filename to dest. If the archive is encrypted, each configured password is tried in turn.
+func (h *Handler) extract(ctx context.Context, filename, dest string) ([]manifest.Entry, error) {
+	files, err := h.unpackTo(ctx, filename, dest, "")
+	if !isPasswordError(err) {
+		return files, err
+	}
+	passwords, err := unpack.Passwords(filepath.Dir(filename), h.opts.Passwords, h.opts.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passwords: %w", err)
+	}
+	for _, password := range passwords {
+		// Progress of the failed attempt does not count towards the total
+		progress.Reset(ctx)
+		files, err := h.unpackTo(ctx, filename, dest, password)
+		if err == nil || !isPasswordError(err) {
+			return files, err
+		}
+	}
+	return nil, fmt.Errorf("archive is encrypted and no password worked: %s: tried %d password(s)", filename, len(passwords))
+}
+
+func (h *Handler) Handle(ctx context.Context, name, postCommand string, remove bool) error {
+	ev, err := eventFrom(name)
+	if err != nil {
+		return err
+	}
+	defer h.locks.Lock(ev.Key())()
+	cd := ev.CommandData()
+	dest, err := h.opts.Dest(cd)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %s: %w", ev.Dir, err)
+	}
+	if manifest.Unpacked(ctx, dest, ev.Name) {
+		return nil
+	}
+	if ev.SFV != nil {
+		if err := ev.Verify(ctx, h.cache, h.opts.VerifyWorkers); err != nil {
+			return err
+		}
+	} else {
+		// Without a SFV, the set is complete when the headers at the end of the last volume can be read. File
+		// checksums stored in the headers are verified while unpacking
+		if err := readHeaders(ev.Name); err != nil {
+			return fmt.Errorf("incomplete: %s: %w", ev.Dir, err)
+		}
+	}
+	ev.Volumes, err = volumes(ev.Name)
+	if err != nil {
+		return fmt.Errorf("incomplete: %s: %w", ev.Dir, err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
+	}
+	size, err := h.checkSpace(ev.Name, dest)
+	if err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
+	}
+	ctx = progress.Start(ctx, ev.Name, size)
+	files, err := h.extract(ctx, ev.Name, dest)
+	if err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
+	}
+	if err := manifest.Record(dest, ev.Name, ev.Sources(), files); err != nil {
+		log.Printf("failed to write manifest: %s: %s", dest, err)
+	}
+	ev.Forget(h.cache)
+	if remove {
+		if err := ev.Remove(); err != nil {
+			return fmt.Errorf("removal failed: %s: %w", ev.Dir, err)
+		}
+	}
+	if err := executil.Run(ctx, postCommand, cd); err != nil {
+		return fmt.Errorf("post-process command failed: %s: %w", ev.Dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package sevenzip
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/mpolden/unp/progress"
+	"github.com/mpolden/unp/unpack"
+)
+
+func testDir(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(wd, "testdata")
+}
+
+func symlink(t *testing.T, oldname, newname string) {
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFirstVolume(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"foo.7z", "foo.7z"},
+		{"foo.7z.001", "foo.7z.001"},
+		{"foo.7z.002", "foo.7z.001"},
+		{"foo.7z.100", "foo.7z.001"},
+		{"foo.7z.1", ""},
+		{"foo.zip", ""},
+		{"foo.nfo", ""},
+	}
+	for i, tt := range tests {
+		got, err := firstVolume(tt.in)
+		if tt.out == "" {
+			if err == nil {
+				t.Errorf("#%d: want error for %s", i, tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if got != tt.out {
+			t.Errorf("#%d: want %s, got %s", i, tt.out, got)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		archive = filepath.Join(dir, "test.7z")
+		out     = filepath.Join(dir, "post")
+		script  = filepath.Join(t.TempDir(), "post.sh")
+	)
+	symlink(t, filepath.Join(testDir(t), "test.7z"), archive)
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Options{Options: unpack.Options{PreserveMode: true, RemoveNested: true}})
+	if err := h.Handle(context.Background(), archive, script+" {{.Name}} {{.Base}} {{.Dir}}", true); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		file string
+		data string
+		mode os.FileMode
+	}{
+		{"test1", "test1\n", 0644},
+		{"test/test2", "test2\n", 0640},
+		{"test/test3", "test3\n", 0644}, // Unpacked from nested archive
+		{"link", "test1", 0777},         // Symbolic link is unpacked as a file containing the target
+	}
+	for i, tt := range tests {
+		name := filepath.Join(dir, filepath.FromSlash(tt.file))
+		if got := readFile(t, name); got != tt.data {
+			t.Errorf("#%d: want %q, got %q", i, tt.data, got)
+		}
+		fi, err := os.Lstat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != tt.mode {
+			t.Errorf("#%d: want mode %o, got %o", i, tt.mode, got)
+		}
+		if want, got := 2020, fi.ModTime().Year(); want != got {
+			t.Errorf("#%d: want mtime in %d, got %d", i, want, got)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "test", "nested.7z")); !os.IsNotExist(err) {
+		t.Error("want nested archive to be removed")
+	}
+	if want, got := fmt.Sprintf("%s test.7z %s\n", archive, dir), readFile(t, out); want != got {
+		t.Errorf("want post-command output %q, got %q", want, got)
+	}
+	if _, err := os.Lstat(archive); !os.IsNotExist(err) {
+		t.Error("want archive to be removed")
+	}
+}
+
+func TestHandleSplit(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		data = readFile(t, filepath.Join(testDir(t), "test.7z"))
+		n    = len(data) / 2
+	)
+	first := filepath.Join(dir, "test.7z.001")
+	if err := os.WriteFile(first, []byte(data[:n]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Options{})
+	if err := h.Handle(context.Background(), first, "", true); err == nil || !strings.HasPrefix(err.Error(), "incomplete: "+dir) {
+		t.Errorf("want incomplete error, got %v", err)
+	}
+
+	last := filepath.Join(dir, "test.7z.002")
+	if err := os.WriteFile(last, []byte(data[n:]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Handle(context.Background(), last, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "test2\n", readFile(t, filepath.Join(dir, "test", "test2")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	for _, name := range []string{first, last} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed", name)
+		}
+	}
+}
+
+func TestHandleSFV(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		archive = filepath.Join(dir, "test.7z")
+		data    = readFile(t, filepath.Join(testDir(t), "test.7z"))
+		sfvFile = filepath.Join(dir, "test.sfv")
+	)
+	if err := os.WriteFile(sfvFile, []byte(fmt.Sprintf("test.7z %08x\n", crc32.ChecksumIEEE([]byte(data)))), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Options{})
+	want := "incomplete: " + dir + ": 0/1 files"
+	if err := h.Handle(context.Background(), sfvFile, "", false); err == nil || err.Error() != want {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+
+	if err := os.WriteFile(archive, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Handle(context.Background(), sfvFile, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "test1\n", readFile(t, filepath.Join(dir, "test1")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	for _, name := range []string{archive, sfvFile} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed", name)
+		}
+	}
+}
+
+func TestHandleEncrypted(t *testing.T) {
+	var tests = []struct {
+		opts         Options
+		passwordFile string
+		err          string
+	}{
+		{Options{}, "", "archive is encrypted and no password worked: "},
+		{Options{Options: unpack.Options{Passwords: []string{"wrong"}}}, "", "archive is encrypted and no password worked: "},
+		{Options{Options: unpack.Options{Passwords: []string{"wrong", "secret"}}}, "", ""},
+		{Options{}, "secret\n", ""},
+	}
+	for i, tt := range tests {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "encrypted.7z")
+		symlink(t, filepath.Join(testDir(t), "encrypted.7z"), archive)
+		if tt.passwordFile != "" {
+			if err := os.WriteFile(filepath.Join(dir, unpack.PasswordFile), []byte(tt.passwordFile), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h := NewHandler(tt.opts)
+		var reports []progress.Progress
+		ctx := progress.WithFunc(context.Background(), func(p progress.Progress) { reports = append(reports, p) })
+		err := h.Handle(ctx, archive, "", false)
+		// Progress of failed password attempts is discarded
+		for _, p := range reports {
+			if p.Done > p.Total {
+				t.Errorf("#%d: want done <= total, got %d/%d", i, p.Done, p.Total)
+			}
+		}
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "test1")); !os.IsNotExist(err) {
+				t.Errorf("#%d: want no files to be unpacked", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if want, got := "test1\n", readFile(t, filepath.Join(dir, "test1")); want != got {
+			t.Errorf("#%d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestHandleCorrupt(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(testDir(t), "test.7z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corruption of an archive that is not encrypted is not mistaken for a wrong password. Only the packed streams
+	// are damaged, which sit between the 32-byte signature header and the header it points to
+	end := 32 + int(binary.LittleEndian.Uint64(data[12:]))
+	for off := 32; off < end; off++ {
+		dir := t.TempDir()
+		corrupt := append([]byte(nil), data...)
+		corrupt[off] ^= 0xff
+		archive := filepath.Join(dir, "test.7z")
+		if err := os.WriteFile(archive, corrupt, 0644); err != nil {
+			t.Fatal(err)
+		}
+		h := NewHandler(Options{Options: unpack.Options{Passwords: []string{"a", "b"}}})
+		if err := h.Handle(context.Background(), archive, "", false); err != nil && strings.Contains(err.Error(), "no password worked") {
+			t.Errorf("offset %d: want corruption error, got %q", off, err)
+		}
+	}
+}
+
+func TestCopyEntry(t *testing.T) {
+	var tests = []struct {
+		crc32 uint32
+		err   string
+	}{
+		{crc32.ChecksumIEEE([]byte("foo")), ""},
+		{0, ""}, // No CRC32 stored
+		{1, "checksum mismatch: foo"},
+	}
+	for i, tt := range tests {
+		f := &sevenzip.File{FileHeader: sevenzip.FileHeader{Name: "foo", UncompressedSize: 3, CRC32: tt.crc32}}
+		var b strings.Builder
+		_, _, err := copyEntry(context.Background(), &b, strings.NewReader("foo"), f)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %s", i, err)
+		}
+	}
+}
+
+func TestHandleUnsafe(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		root := t.TempDir()
+		dir := filepath.Join(root, "a")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		archive := filepath.Join(dir, "unsafe.7z")
+		symlink(t, filepath.Join(testDir(t), "unsafe.7z"), archive)
+
+		h := NewHandler(Options{Options: unpack.Options{SkipUnsafe: skip}})
+		err := h.Handle(context.Background(), archive, "", false)
+		if skip {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "ok")); err != nil {
+				t.Errorf("want safe entry to be unpacked: %s", err)
+			}
+		} else if want := "unsafe entry: path traversal: ../evil"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want err = %q, got %v", want, err)
+		}
+		if _, err := os.Lstat(filepath.Join(root, "evil")); err == nil {
+			t.Error("unsafe entry unpacked")
+		}
+	}
+}
+
+func TestHandleNesting(t *testing.T) {
+	dir := t.TempDir()
+	symlink(t, filepath.Join(testDir(t), "test.7z"), filepath.Join(dir, "test.7z"))
+	h := NewHandler(Options{Options: unpack.Options{MaxNesting: -1}})
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.7z"), "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test", "test3")); !os.IsNotExist(err) {
+		t.Error("want nested archive to be left as is")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test", "nested.7z")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	symlink(t, filepath.Join(testDir(t), "test.7z"), filepath.Join(dir, "test.7z"))
+	h := NewHandler(Options{Options: unpack.Options{Symlinks: true}})
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.7z"), "", false); err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Readlink(filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "test1"; target != want {
+		t.Errorf("want link to %s, got %s", want, target)
+	}
+}
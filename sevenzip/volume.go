@@ -0,0 +1,55 @@
+package sevenzip
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var (
+	// sevenZipRE matches single volume archives.
+	sevenZipRE = regexp.MustCompile(`\.7z$`)
+	// sevenZipPartRE matches volumes of a multi-volume archive, named .7z.001, .7z.002 and so on.
+	sevenZipPartRE = regexp.MustCompile(`\.7z\.(\d{3})$`)
+)
+
+// firstVolume returns the name of the first volume in the 7z set that the volume name belongs to.
+func firstVolume(name string) (string, error) {
+	if m := sevenZipPartRE.FindStringSubmatchIndex(name); m != nil {
+		return name[:m[2]] + "001", nil
+	}
+	if sevenZipRE.MatchString(name) {
+		return name, nil
+	}
+	return "", fmt.Errorf("not a 7z volume: %s", name)
+}
+
+// volumeName returns the name of volume n, counting from zero, in the 7z set starting with the volume first.
+func volumeName(first string, n int) string {
+	if !sevenZipPartRE.MatchString(first) {
+		return first
+	}
+	return first[:len(first)-len("001")] + fmt.Sprintf("%03d", n+1)
+}
+
+// volumes returns the volumes of the 7z set starting with the volume first. Volumes are read until the first missing
+// one, which is also how they are read when unpacking.
+func volumes(first string) ([]string, error) {
+	if _, err := os.Stat(first); err != nil {
+		return nil, err
+	}
+	vs := []string{first}
+	if !sevenZipPartRE.MatchString(first) {
+		return vs, nil
+	}
+	for i := 1; ; i++ {
+		name := volumeName(first, i)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		vs = append(vs, name)
+	}
+	return vs, nil
+}
@@ -0,0 +1,276 @@
+package sfvutil
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mpolden/unp/fsutil"
+)
+
+const (
+	// defaultCacheTTL is the default duration an unused cache entry is kept for.
+	defaultCacheTTL = 7 * 24 * time.Hour
+	// defaultCacheSize is the default maximum number of cache entries.
+	defaultCacheSize = 10000
+	// pruneInterval is how often entries of files that no longer exist, and expired entries, are removed.
+	pruneInterval = time.Hour
+)
+
+// fileState describes a file whose checksum has been verified. The checksum is only valid while the file has the same
+// size, modification time and inode. CRC32 checksums are stored as numbers, and other checksums as the algorithm and
+// hex-encoded hash.
+type fileState struct {
+	CRC32   uint32 `json:"crc32"`
+	Sum     string `json:"sum,omitempty"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode"`
+}
+
+type cacheEntry struct {
+	fileState
+	Used int64 `json:"used"`
+}
+
+// cacheItem is an entry in the list of entries, ordered from most to least recently used.
+type cacheItem struct {
+	path string
+	cacheEntry
+}
+
+type cacheState struct {
+	Files map[string]cacheEntry `json:"files"`
+}
+
+// Cache holds verified checksums, optionally persisted to a state file. Entries that have not been used within ttl
+// expire, and the least recently used entries are evicted when the cache holds more than size entries. A cache is safe
+// for concurrent use.
+type Cache struct {
+	mu            sync.Mutex
+	filename      string
+	ttl           time.Duration
+	size          int
+	entries       map[string]*list.Element
+	lru           *list.List
+	dirty         bool
+	now           func() time.Time
+	pruneInterval time.Duration
+	pruneTimer    *time.Timer
+	closed        bool
+}
+
+// NewCache creates a new cache persisted to filename. An empty filename keeps the cache in memory only. A ttl or size
+// of zero selects the default.
+func NewCache(filename string, ttl time.Duration, size int) *Cache {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &Cache{
+		filename:      filename,
+		ttl:           ttl,
+		size:          size,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		now:           time.Now,
+		pruneInterval: pruneInterval,
+	}
+}
+
+// statFile returns the state of the file in checksum c, as it currently exists on disk.
+func statFile(c Checksum) (fileState, error) {
+	fi, err := os.Stat(c.Path)
+	if err != nil {
+		return fileState{}, err
+	}
+	f := fileState{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Inode:   fsutil.Inode(fi),
+	}
+	if c.Algorithm == "crc32" && len(c.Sum) == 4 {
+		f.CRC32 = binary.BigEndian.Uint32(c.Sum)
+	} else {
+		f.Sum = c.Algorithm + ":" + hex.EncodeToString(c.Sum)
+	}
+	return f, nil
+}
+
+func (c *Cache) expired(e cacheEntry) bool { return c.now().Sub(time.Unix(0, e.Used)) > c.ttl }
+
+// verified returns whether checksum c has been verified for the file as it currently exists on disk. An entry for a
+// file that has been modified or replaced since it was verified is removed.
+func (c *Cache) verified(cs Checksum) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cs.Path]
+	if !ok {
+		return false
+	}
+	item := el.Value.(*cacheItem)
+	cur, err := statFile(cs)
+	if err != nil || cur != item.fileState || c.expired(item.cacheEntry) {
+		c.removeLocked(cs.Path)
+		return false
+	}
+	item.Used = c.now().UnixNano()
+	c.lru.MoveToFront(el)
+	c.dirty = true
+	return true
+}
+
+// add adds the state of a verified file to the cache, evicting the least recently used entries if the cache is full.
+func (c *Cache) add(path string, f fileState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.putLocked(path, cacheEntry{fileState: f, Used: c.now().UnixNano()})
+	c.dirty = true
+	c.evictLocked()
+	c.schedulePruneLocked()
+}
+
+// putLocked sets the entry for path and marks it as the most recently used.
+func (c *Cache) putLocked(path string, e cacheEntry) {
+	if el, ok := c.entries[path]; ok {
+		el.Value.(*cacheItem).cacheEntry = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[path] = c.lru.PushFront(&cacheItem{path: path, cacheEntry: e})
+}
+
+// evictLocked removes the least recently used entries while the cache holds more than size entries.
+func (c *Cache) evictLocked() {
+	for c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back().Value.(*cacheItem).path)
+	}
+}
+
+// schedulePruneLocked starts a timer that prunes the cache, unless one is already running or the cache is closed.
+func (c *Cache) schedulePruneLocked() {
+	if c.pruneTimer == nil && !c.closed {
+		c.pruneTimer = time.AfterFunc(c.pruneInterval, c.prune)
+	}
+}
+
+// Remove removes the entry for path.
+func (c *Cache) Remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(path)
+}
+
+func (c *Cache) removeLocked(path string) {
+	if el, ok := c.entries[path]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, path)
+		c.dirty = true
+	}
+}
+
+// prune removes expired entries, and entries for files that no longer exist. It runs periodically while the cache has
+// entries.
+func (c *Cache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, el := range c.entries {
+		if c.expired(el.Value.(*cacheItem).cacheEntry) {
+			c.removeLocked(path)
+		} else if _, err := os.Stat(path); os.IsNotExist(err) {
+			c.removeLocked(path)
+		}
+	}
+	if c.pruneTimer != nil {
+		c.pruneTimer.Stop()
+		c.pruneTimer = nil
+	}
+	if len(c.entries) > 0 {
+		c.schedulePruneLocked()
+	}
+}
+
+// Close stops pruning the cache periodically. The cache remains usable, but expired entries are only removed when
+// looked up.
+func (c *Cache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.pruneTimer != nil {
+		c.pruneTimer.Stop()
+		c.pruneTimer = nil
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Load reads the state file of this cache. A missing state file is not an error.
+func (c *Cache) Load() error {
+	if c.filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state cacheState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(state.Files))
+	for path := range state.Files {
+		paths = append(paths, path)
+	}
+	// Add entries from least to most recently used, so that they keep their order
+	sort.Slice(paths, func(i, j int) bool { return state.Files[paths[i]].Used < state.Files[paths[j]].Used })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, path := range paths {
+		c.putLocked(path, state.Files[path])
+	}
+	c.evictLocked()
+	if len(c.entries) > 0 {
+		c.schedulePruneLocked()
+	}
+	return nil
+}
+
+// Save writes the state file of this cache, if it has changed since it was last saved.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.filename == "" || !c.dirty {
+		return nil
+	}
+	state := cacheState{Files: make(map[string]cacheEntry, len(c.entries))}
+	for path, el := range c.entries {
+		state.Files[path] = el.Value.(*cacheItem).cacheEntry
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.filename), 0755); err != nil {
+		return err
+	}
+	if err := fsutil.WriteFile(c.filename, data, 0644); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
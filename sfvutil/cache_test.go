@@ -0,0 +1,166 @@
+package sfvutil
+
+import (
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mpolden/sfv"
+)
+
+func TestCache(t *testing.T) {
+	var (
+		dir       = t.TempDir()
+		name      = filepath.Join(dir, "foo.rar")
+		cacheFile = filepath.Join(dir, "state", "cache.json")
+		data      = []byte("foo")
+		c         = sfvChecksum(sfv.Checksum{Filename: "foo.rar", Path: name, CRC32: crc32.ChecksumIEEE(data)})
+	)
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(cacheFile, 0, 0)
+	if cache.verified(c) {
+		t.Errorf("want %s to not be verified", name)
+	}
+	f, err := statFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.add(c.Path, f)
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries are loaded from state file
+	cache = NewCache(cacheFile, 0, 0)
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !cache.verified(c) {
+		t.Errorf("want %s to be verified", name)
+	}
+
+	// Entry is invalid if checksum differs
+	other := sfvChecksum(sfv.Checksum{Path: name, CRC32: crc32.ChecksumIEEE(data) + 1})
+	if cache.verified(other) {
+		t.Errorf("want %s with different checksum to not be verified", name)
+	}
+
+	// Entry is invalid if file is modified
+	if err := os.WriteFile(name, []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if cache.verified(c) {
+		t.Errorf("want modified %s to not be verified", name)
+	}
+
+	// Missing state file is not an error
+	if err := NewCache(filepath.Join(dir, "missing.json"), 0, 0).Load(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCacheExpiryAndEviction(t *testing.T) {
+	dir := t.TempDir()
+	var checksums []Checksum
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		checksums = append(checksums, sfvChecksum(sfv.Checksum{Filename: name, Path: path, CRC32: crc32.ChecksumIEEE([]byte(name))}))
+	}
+	now := time.Now()
+	cache := NewCache("", time.Hour, 2)
+	cache.now = func() time.Time { return now }
+	add := func(c Checksum) {
+		f, err := statFile(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.add(c.Path, f)
+		now = now.Add(time.Minute)
+	}
+
+	// Least recently used entry is evicted
+	add(checksums[0])
+	add(checksums[1])
+	if !cache.verified(checksums[0]) {
+		t.Fatalf("want %s to be verified", checksums[0].Path)
+	}
+	add(checksums[2])
+	if want, got := 2, cache.Len(); want != got {
+		t.Errorf("want %d cache entries, got %d", want, got)
+	}
+	if cache.verified(checksums[1]) {
+		t.Errorf("want %s to be evicted", checksums[1].Path)
+	}
+
+	// Unused entries expire
+	now = now.Add(time.Hour)
+	cache.prune()
+	if want, got := 0, cache.Len(); want != got {
+		t.Errorf("want %d cache entries, got %d", want, got)
+	}
+}
+
+func TestCachePruneTimer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := sfvChecksum(sfv.Checksum{Filename: "a", Path: path, CRC32: crc32.ChecksumIEEE([]byte("a"))})
+	f, err := statFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCache("", 0, 0)
+	cache.pruneInterval = 10 * time.Millisecond
+	cache.add(c.Path, f)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries of removed files are pruned periodically
+	ts := time.Now()
+	for cache.Len() > 0 {
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(ts) > 2*time.Second {
+			t.Fatal("timed out waiting for cache to be pruned")
+		}
+	}
+}
+
+func TestCacheClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := sfvChecksum(sfv.Checksum{Filename: "a", Path: path, CRC32: crc32.ChecksumIEEE([]byte("a"))})
+	f, err := statFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCache("", 0, 0)
+	cache.pruneInterval = 10 * time.Millisecond
+	cache.add(c.Path, f)
+	cache.Close()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closed cache is no longer pruned, not even after adding entries
+	cache.add(c.Path, f)
+	time.Sleep(50 * time.Millisecond)
+	if want, got := 1, cache.Len(); want != got {
+		t.Errorf("want len = %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,215 @@
+package sfvutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mpolden/sfv"
+	"github.com/mpolden/unp/pathutil"
+)
+
+// algorithms are the hash algorithms of checksum files, keyed by file extension.
+var algorithms = map[string]string{
+	".sfv":    "crc32",
+	".md5":    "md5",
+	".sha1":   "sha1",
+	".sha256": "sha256",
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+}
+
+// Checksum is the expected checksum of a file.
+type Checksum struct {
+	Path string
+	// Algorithm is the hash algorithm of the checksum. This is one of crc32, md5, sha1 or sha256.
+	Algorithm string
+	// Sum is the expected hash of the file.
+	Sum []byte
+}
+
+// Verify hashes the file of c and returns whether the hash matches the expected one.
+func (c Checksum) Verify() (bool, error) {
+	h, err := newHash(c.Algorithm)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), c.Sum), nil
+}
+
+// List is a list of checksums read from a checksum file.
+type List struct {
+	Path      string
+	Checksums []Checksum
+}
+
+func sfvChecksum(c sfv.Checksum) Checksum {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, c.CRC32)
+	return Checksum{Path: c.Path, Algorithm: "crc32", Sum: sum}
+}
+
+// FromSFV returns the list of checksums in s.
+func FromSFV(s *sfv.SFV) *List {
+	l := &List{Path: s.Path}
+	for _, c := range s.Checksums {
+		l.Checksums = append(l.Checksums, sfvChecksum(c))
+	}
+	return l
+}
+
+// IsList returns whether name is a checksum file that can be read by ReadList.
+func IsList(name string) bool {
+	_, ok := algorithms[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// bsdLineRE matches a line in the BSD format of checksum files, such as MD5 (foo.mkv) = d41d8cd98f00b204e9800998ecf8427e.
+var bsdLineRE = regexp.MustCompile(`^([A-Za-z0-9]+) \((.*)\) = ([0-9A-Fa-f]+)$`)
+
+// parseLine parses a line of a checksum file in either the format of md5sum and friends, or the BSD format. The hash
+// and file name of the line are returned.
+func parseLine(line, algorithm string) (string, string, error) {
+	if m := bsdLineRE.FindStringSubmatch(line); m != nil {
+		if !strings.EqualFold(m[1], algorithm) {
+			return "", "", fmt.Errorf("want %s checksum, got %s", algorithm, m[1])
+		}
+		return m[3], m[2], nil
+	}
+	sum, file, ok := strings.Cut(line, " ")
+	if !ok {
+		return "", "", fmt.Errorf("invalid line: %q", line)
+	}
+	// Binary mode is marked with an asterisk before the file name
+	return sum, strings.TrimPrefix(strings.TrimLeft(file, " "), "*"), nil
+}
+
+// listedPath returns the path of the file listed in the checksum file name. Listed files must be inside the directory
+// of the checksum file.
+func listedPath(name, file string) (string, error) {
+	path, err := pathutil.Join(filepath.Dir(name), filepath.FromSlash(strings.ReplaceAll(file, `\`, "/")))
+	if err != nil {
+		return "", fmt.Errorf("%s: unsafe path: %w", name, err)
+	}
+	return path, nil
+}
+
+// readSFV reads the SFV file name, rejecting it if it lists files outside its directory.
+func readSFV(name string) (*sfv.SFV, error) {
+	s, err := sfv.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range s.Checksums {
+		path, err := listedPath(name, c.Filename)
+		if err != nil {
+			return nil, err
+		}
+		s.Checksums[i].Path = path
+	}
+	return s, nil
+}
+
+// ReadList reads the checksum file name. The hash algorithm is given by the file extension, which is one of .sfv, .md5,
+// .sha1 or .sha256. Files other than SFVs use either the format of md5sum and friends, where each line holds a
+// hex-encoded hash followed by the file name, or the BSD format written by md5 and shasum --tag.
+func ReadList(name string) (*List, error) {
+	algorithm, ok := algorithms[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		return nil, fmt.Errorf("not a checksum file: %s", name)
+	}
+	if algorithm == "crc32" {
+		s, err := readSFV(name)
+		if err != nil {
+			return nil, err
+		}
+		return FromSFV(s), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, _ := newHash(algorithm)
+	l := &List{Path: name}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		sum, file, err := parseLine(line, algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		b, err := hex.DecodeString(sum)
+		if err != nil || len(b) != h.Size() {
+			return nil, fmt.Errorf("%s: invalid %s checksum: %q", name, algorithm, sum)
+		}
+		path, err := listedPath(name, file)
+		if err != nil {
+			return nil, err
+		}
+		l.Checksums = append(l.Checksums, Checksum{Path: path, Algorithm: algorithm, Sum: b})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ReadLists reads all checksum files in dir. Checksum files that cannot be read are logged and skipped, so that they do
+// not prevent other files in dir from being verified.
+func ReadLists(dir string) ([]*List, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var lists []*List
+	for _, e := range entries {
+		if e.IsDir() || !IsList(e.Name()) {
+			continue
+		}
+		name := filepath.Join(dir, e.Name())
+		l, err := ReadList(name)
+		if err != nil {
+			log.Printf("skipping invalid checksum file %s: %s", name, err)
+			continue
+		}
+		lists = append(lists, l)
+	}
+	return lists, nil
+}
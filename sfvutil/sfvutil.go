@@ -0,0 +1,147 @@
+package sfvutil
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/mpolden/sfv"
+)
+
+// ReadDir reads all SFV files in dir.
+func ReadDir(dir string) ([]*sfv.SFV, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var sfvs []*sfv.SFV
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".sfv" {
+			continue
+		}
+		s, err := readSFV(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sfvs = append(sfvs, s)
+	}
+	return sfvs, nil
+}
+
+// Find returns the SFV in sfvs describing the set that filename belongs to. A file belongs to a set if it is the SFV
+// itself, if it is listed in the SFV, or if it is a volume whose first volume, as returned by firstVolume, is listed in
+// the SFV. Other files belong to the only set in their directory, if there is exactly one. If no set is found, nil is
+// returned.
+func Find(filename string, sfvs []*sfv.SFV, firstVolume func(name string) (string, error)) *sfv.SFV {
+	filename = filepath.Clean(filename)
+	first, err := firstVolume(filename)
+	isVolume := err == nil
+	for _, s := range sfvs {
+		if filepath.Clean(s.Path) == filename {
+			return s
+		}
+		for _, c := range s.Checksums {
+			p := filepath.Clean(c.Path)
+			if p == filename || (isVolume && p == first) {
+				return s
+			}
+		}
+	}
+	if len(sfvs) == 1 && !isVolume {
+		return sfvs[0]
+	}
+	return nil
+}
+
+// verifyChecksum verifies the file in checksum cs and caches the result. A missing file fails verification.
+func (c *Cache) verifyChecksum(cs Checksum) (bool, error) {
+	// Stat before hashing, so that changes made while hashing invalidate the entry
+	f, err := statFile(cs)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	ok, err := cs.Verify()
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		c.add(cs.Path, f)
+	}
+	return ok, nil
+}
+
+// Verify verifies all files in s and returns the number of files that passed, out of the total number of files.
+// Files that are not cached are verified concurrently by the given number of workers. If workers is zero or negative,
+// GOMAXPROCS workers are used.
+func (c *Cache) Verify(ctx context.Context, s *sfv.SFV, workers int) (int, int, error) {
+	return c.VerifyList(ctx, FromSFV(s), workers)
+}
+
+// VerifyList verifies all files in l, like Verify.
+func (c *Cache) VerifyList(ctx context.Context, l *List, workers int) (int, int, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		passed int
+		err    error
+	)
+	checksums := make(chan Checksum)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cs := range checksums {
+				ok, verr := c.verifyChecksum(cs)
+				mu.Lock()
+				if ok {
+					passed++
+				}
+				if verr != nil && err == nil {
+					err = verr
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, cs := range l.Checksums {
+		mu.Lock()
+		if err == nil {
+			err = ctx.Err()
+		}
+		failed := err != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		if c.verified(cs) {
+			mu.Lock()
+			passed++
+			mu.Unlock()
+			continue
+		}
+		checksums <- cs
+	}
+	close(checksums)
+	wg.Wait()
+	if err != nil {
+		return 0, 0, err
+	}
+	return passed, len(l.Checksums), nil
+}
+
+// Forget removes the entries for all files in s.
+func (c *Cache) Forget(s *sfv.SFV) { c.ForgetList(FromSFV(s)) }
+
+// ForgetList removes the entries for all files in l.
+func (c *Cache) ForgetList(l *List) {
+	for _, cs := range l.Checksums {
+		c.Remove(cs.Path)
+	}
+}
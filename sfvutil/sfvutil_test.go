@@ -0,0 +1,136 @@
+package sfvutil
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpolden/sfv"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	var lines []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("foo.r%02d", i)
+		data := []byte(name)
+		crc := crc32.ChecksumIEEE(data)
+		switch i % 4 {
+		case 1:
+			crc++ // Corrupt
+		case 2:
+			data = nil // Missing
+		}
+		if data != nil {
+			if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s %08x", name, crc))
+	}
+	sfvFile := filepath.Join(dir, "foo.sfv")
+	if err := os.WriteFile(sfvFile, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := sfv.Read(sfvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{0, 1, 8} {
+		cache := NewCache("", 0, 0)
+		for i := 0; i < 2; i++ {
+			passed, total, err := cache.Verify(context.Background(), s, workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if passed != 10 || total != 20 {
+				t.Errorf("workers=%d: want 10/20 files, got %d/%d", workers, passed, total)
+			}
+		}
+		if want, got := 10, cache.Len(); want != got {
+			t.Errorf("workers=%d: want %d cache entries, got %d", workers, want, got)
+		}
+	}
+}
+
+func TestReadList(t *testing.T) {
+	dir := t.TempDir()
+	var tests = []struct {
+		name      string
+		data      string
+		algorithm string
+		paths     []string
+	}{
+		{"foo.sfv", "; comment\nfoo.r00 c7c1f16a\n", "crc32", []string{"foo.r00"}},
+		{"foo.md5", "# comment\nd41d8cd98f00b204e9800998ecf8427e  foo bar.mkv\nd41d8cd98f00b204e9800998ecf8427e *sub/baz.mkv\n", "md5", []string{"foo bar.mkv", "sub/baz.mkv"}},
+		{"foo.SHA1", "da39a3ee5e6b4b0d3255bfef95601890afd80709  foo.mkv\n", "sha1", []string{"foo.mkv"}},
+		{"foo.sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  foo.mkv\n", "sha256", []string{"foo.mkv"}},
+		{"bsd.md5", "MD5 (foo bar.mkv) = d41d8cd98f00b204e9800998ecf8427e\nMD5 (sub/(baz).mkv) = D41D8CD98F00B204E9800998ECF8427E\n", "md5", []string{"foo bar.mkv", "sub/(baz).mkv"}},
+		{"bsd.sha256", "SHA256 (foo.mkv) = e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n", "sha256", []string{"foo.mkv"}},
+		{"bsd.sha1", "MD5 (foo.mkv) = d41d8cd98f00b204e9800998ecf8427e\n", "", nil},
+		{"bad.md5", "da39a3ee5e6b4b0d3255bfef95601890afd80709  foo.mkv\n", "", nil},
+		{"traversal.md5", "d41d8cd98f00b204e9800998ecf8427e  ../foo.mkv\n", "", nil},
+		{"backslash.md5", "d41d8cd98f00b204e9800998ecf8427e  sub\\..\\..\\foo.mkv\n", "", nil},
+		{"absolute.md5", "d41d8cd98f00b204e9800998ecf8427e  /etc/passwd\n", "", nil},
+		{"traversal.sfv", "../foo.mkv 00000000\n", "", nil},
+		{"backslash.sfv", "sub\\..\\..\\foo.mkv 00000000\n", "", nil},
+		{"absolute.sfv", "/etc/passwd 00000000\n", "", nil},
+		{"sub.sfv", "sub\\foo.mkv 00000000\n", "crc32", []string{"sub/foo.mkv"}},
+		{"foo.nfo", "", "", nil},
+	}
+	for i, tt := range tests {
+		name := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(name, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l, err := ReadList(name)
+		if tt.algorithm == "" {
+			if err == nil {
+				t.Errorf("#%d: want error for %s", i, tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if len(l.Checksums) != len(tt.paths) {
+			t.Fatalf("#%d: want %d checksums, got %d", i, len(tt.paths), len(l.Checksums))
+		}
+		for j, c := range l.Checksums {
+			if want := filepath.Join(dir, filepath.FromSlash(tt.paths[j])); c.Path != want {
+				t.Errorf("#%d: want path %s, got %s", i, want, c.Path)
+			}
+			if c.Algorithm != tt.algorithm {
+				t.Errorf("#%d: want algorithm %s, got %s", i, tt.algorithm, c.Algorithm)
+			}
+		}
+	}
+}
+
+func TestReadLists(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"good.md5": "d41d8cd98f00b204e9800998ecf8427e  foo.mkv\n",
+		"bad.md5":  "not a checksum\n",
+		"foo.nfo":  "",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lists, err := ReadLists(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 1 {
+		t.Fatalf("want 1 list, got %d", len(lists))
+	}
+	if want := filepath.Join(dir, "good.md5"); lists[0].Path != want {
+		t.Errorf("want %s, got %s", want, lists[0].Path)
+	}
+}
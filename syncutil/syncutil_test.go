@@ -0,0 +1,39 @@
+package syncutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyMutex(t *testing.T) {
+	var m KeyMutex
+	unlockA := m.Lock("a")
+
+	// Different set can be locked concurrently
+	locked := make(chan func())
+	go func() { locked <- m.Lock("b") }()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out locking another set")
+	}
+
+	// Same set is serialized
+	go func() { locked <- m.Lock("a") }()
+	select {
+	case <-locked:
+		t.Fatal("want lock to block while set is locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out locking unlocked set")
+	}
+	if want, got := 0, m.len(); want != got {
+		t.Errorf("want %d locks, got %d", want, got)
+	}
+}
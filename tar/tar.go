@@ -0,0 +1,346 @@
+package tar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/pathutil"
+	"github.com/mpolden/unp/progress"
+	"github.com/mpolden/unp/syncutil"
+	"github.com/mpolden/unp/unpack"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats of a tar archive.
+const (
+	compressionNone = iota
+	compressionGzip
+	compressionBzip2
+	compressionZstd
+	compressionXz
+)
+
+// magics maps the magic bytes starting a compressed stream to its compression format.
+var magics = []struct {
+	magic       []byte
+	compression int
+}{
+	{[]byte{0x1f, 0x8b}, compressionGzip},
+	{[]byte("BZh"), compressionBzip2},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, compressionZstd},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, compressionXz},
+}
+
+const (
+	// magicOffset is the offset of the magic in a tar header.
+	magicOffset = 257
+	// headerSize is the size of a tar header.
+	headerSize = 512
+)
+
+// Options configures how a Handler unpacks archives.
+type Options struct {
+	unpack.Options
+	// HardLinks unpacks hard links as links to a previously unpacked file. If false, hard links are skipped.
+	HardLinks bool
+}
+
+// Handler unpacks tar archives, which may be compressed with gzip, bzip2, zstd or xz.
+type Handler struct {
+	locks syncutil.KeyMutex
+	opts  Options
+}
+
+func NewHandler(opts Options) *Handler { return &Handler{opts: opts} }
+
+// compression detects the compression format of the tar archive read by r. An error is returned if r is neither a
+// compressed stream nor a tar archive. An uncompressed archive is detected first, as the name of its first entry may
+// start with the magic of a compression format.
+func compression(r *bufio.Reader) (int, error) {
+	if b, err := r.Peek(headerSize); err == nil && bytes.HasPrefix(b[magicOffset:], []byte("ustar")) {
+		return compressionNone, nil
+	}
+	for _, m := range magics {
+		if b, err := r.Peek(len(m.magic)); err == nil && bytes.Equal(b, m.magic) {
+			return m.compression, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown format")
+}
+
+// decompress returns a reader that decompresses the tar archive read by r.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	c, err := compression(br)
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case compressionGzip:
+		return gzip.NewReader(br)
+	case compressionBzip2:
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case compressionZstd:
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case compressionXz:
+		d, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(d), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// checkTar returns an error if name is not a tar archive, possibly compressed.
+func checkTar(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := compression(bufio.NewReader(f)); err != nil {
+		return fmt.Errorf("not a tar archive: %s: %w", name, err)
+	}
+	return nil
+}
+
+// chmod sets the permission bits of name to the ones stored in header. Directories always remain accessible to their
+// owner, so that they can be written to and published.
+func chmod(name string, header *tar.Header) error {
+	mode := header.FileInfo().Mode().Perm()
+	if header.Typeflag == tar.TypeDir {
+		mode |= 0700
+	}
+	return os.Chmod(name, mode)
+}
+
+func chtimes(name string, header *tar.Header) error {
+	if header.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(name, header.ModTime, header.ModTime)
+}
+
+// copyEntry copies the contents of the entry described by header from r to w. Unlike RAR and zip, tar stores no
+// checksum of file contents, so corruption is only detected by the compression layer. The number of bytes copied and
+// their CRC32 is returned.
+func copyEntry(w io.Writer, r io.Reader, header *tar.Header) (int64, uint32, error) {
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, hash), r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+	}
+	if n != header.Size {
+		return 0, 0, fmt.Errorf("size mismatch: %s: want %d bytes, got %d", header.Name, header.Size, n)
+	}
+	return n, hash.Sum32(), nil
+}
+
+// unpack unpacks the archive filename to dir. Existing files in dest, which is the directory that dir is eventually
+// published to, are handled according to the overwrite policy. The regular files that were unpacked are returned,
+// relative to dir.
+func (h *Handler) unpack(ctx context.Context, filename, dir, dest string) ([]manifest.Entry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer f.Close()
+	// Progress is tracked on the archive as stored, whose size is known in advance
+	rc, err := decompress(unpack.Reader(ctx, f))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer rc.Close()
+	r := tar.NewReader(rc)
+	var files []manifest.Entry
+	links := make(unpack.Links)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.opts.Skip(header.Name) {
+			continue
+		}
+		name, err := pathutil.Join(dir, header.Name)
+		if err != nil {
+			if err := h.opts.Unsafe(filename, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var src io.Reader = r
+		var symlinkTo, hardLinkTo string
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// If entry is a directory, create it and set correct ctime
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return nil, err
+			}
+			if h.opts.PreserveMode {
+				if err := chmod(name, header); err != nil {
+					return nil, err
+				}
+			}
+			if err := chtimes(name, header); err != nil {
+				return nil, err
+			}
+			continue
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			if !h.opts.Symlinks {
+				// Write the link target as file contents, which is safe wherever it points
+				src = bytes.NewReader([]byte(header.Linkname))
+				header.Size = int64(len(header.Linkname))
+				break
+			}
+			if err := unpack.CheckSymlink(dir, name, header.Linkname); err != nil {
+				if err := h.opts.Unsafe(filename, fmt.Errorf("%s: %w", header.Name, err)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			symlinkTo = header.Linkname
+		case tar.TypeLink:
+			if !h.opts.HardLinks {
+				log.Printf("skipping hard link in %s: %s", filename, header.Name)
+				continue
+			}
+			// Hard link targets are relative to the archive root
+			if _, err := pathutil.Join(dir, header.Linkname); err != nil {
+				if err := h.opts.Unsafe(filename, fmt.Errorf("%s: %w", header.Name, err)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			var ok bool
+			if hardLinkTo, ok = links.Target(header.Linkname); !ok {
+				log.Printf("skipping hard link in %s: %s: target not unpacked: %s", filename, header.Name, header.Linkname)
+				continue
+			}
+		default:
+			log.Printf("skipping unsupported entry in %s: %s", filename, header.Name)
+			continue
+		}
+		name, err = h.opts.Target(dir, dest, name, header.Name, header.ModTime)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		if symlinkTo != "" || hardLinkTo != "" {
+			if err := unpack.Link(name, symlinkTo, hardLinkTo); err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+			}
+			if hardLinkTo != "" {
+				links.Add(header.Name, name)
+			}
+			continue
+		}
+		// Unpack file
+		progress.SetEntry(ctx, header.Name)
+		out, err := os.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file: %s: %w", name, err)
+		}
+		n, crc, err := copyEntry(out, src, header)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+		if h.opts.PreserveMode {
+			if err := chmod(name, header); err != nil {
+				return nil, err
+			}
+		}
+		// Set correct ctime of unpacked file
+		if err := chtimes(name, header); err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, manifest.Entry{Name: filepath.ToSlash(rel), Size: n, CRC32: fmt.Sprintf("%08x", crc)})
+		links.Add(header.Name, name)
+	}
+	// Read the remainder of the stream, so that trailing corruption is detected by the compression layer
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return files, nil
+}
+
+// extract unpacks filename to dest, through a staging directory.
+func (h *Handler) extract(ctx context.Context, filename, dest string) ([]manifest.Entry, error) {
+	return h.opts.Staged(dest, func(dir string) ([]manifest.Entry, error) {
+		return h.unpack(ctx, filename, dir, dest)
+	})
+}
+
+func (h *Handler) Handle(ctx context.Context, name, postCommand string, remove bool) error {
+	if err := checkTar(name); err != nil {
+		return err
+	}
+	defer h.locks.Lock(name)()
+	cd := executil.CommandData{Base: filepath.Base(name), Dir: filepath.Dir(name), Name: name}
+	dest, err := h.opts.Dest(cd)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %s: %w", cd.Dir, err)
+	}
+	if manifest.Unpacked(ctx, dest, name) {
+		return nil
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", cd.Dir, err)
+	}
+	ctx = progress.Start(ctx, name, fi.Size())
+	files, err := h.extract(ctx, name, dest)
+	if err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", cd.Dir, err)
+	}
+	if err := manifest.Record(dest, name, []string{name}, files); err != nil {
+		log.Printf("failed to write manifest: %s: %s", dest, err)
+	}
+	if remove {
+		if err := os.Remove(name); err != nil {
+			return fmt.Errorf("removal failed: %s: %w", cd.Dir, err)
+		}
+	}
+	if err := executil.Run(ctx, postCommand, cd); err != nil {
+		return fmt.Errorf("post-process command failed: %s: %w", cd.Dir, err)
+	}
+	return nil
+}
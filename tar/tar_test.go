@@ -0,0 +1,332 @@
+package tar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpolden/unp/unpack"
+)
+
+func testDir(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(wd, "testdata")
+}
+
+func symlink(t *testing.T, oldname, newname string) {
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func writeTar(t *testing.T, name string, headers ...*tar.Header) {
+	t.Helper()
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := w.Write([]byte(h.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var tests = []struct {
+		file        string
+		compression int
+	}{
+		{"test.tar", compressionNone},
+		{"test.tar.gz", compressionGzip},
+		{"test.tar.bz2", compressionBzip2},
+		{"test.tar.zst", compressionZstd},
+		{"test.tar.xz", compressionXz},
+	}
+	for i, tt := range tests {
+		f, err := os.Open(filepath.Join(testDir(t), tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := compression(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if got != tt.compression {
+			t.Errorf("#%d: want compression %d, got %d for %s", i, tt.compression, got, tt.file)
+		}
+	}
+	if _, err := compression(bufio.NewReader(strings.NewReader("foo"))); err == nil {
+		t.Error("want error for unknown format")
+	}
+	// An uncompressed archive whose first entry starts with the bzip2 magic
+	name := filepath.Join(t.TempDir(), "bzh.tar")
+	writeTar(t, name, &tar.Header{Name: "BZh91AY&SY", Typeflag: tar.TypeReg, Mode: 0644})
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := compression(bufio.NewReader(f)); err != nil || got != compressionNone {
+		t.Errorf("want compression %d, got %d (%v)", compressionNone, got, err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	for _, file := range []string{"test.tar", "test.tar.gz", "test.tar.bz2", "test.tar.zst", "test.tar.xz"} {
+		var (
+			dir     = t.TempDir()
+			archive = filepath.Join(dir, file)
+			out     = filepath.Join(dir, "post")
+			script  = filepath.Join(t.TempDir(), "post.sh")
+		)
+		symlink(t, filepath.Join(testDir(t), file), archive)
+		if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		h := NewHandler(Options{Options: unpack.Options{PreserveMode: true}})
+		if err := h.Handle(context.Background(), archive, script+" {{.Name}} {{.Base}} {{.Dir}}", true); err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		var tests = []struct {
+			file string
+			data string
+			mode os.FileMode
+		}{
+			{"test1", "test1\n", 0644},
+			{"test/test2", "test2\n", 0640},
+			{"link", "test1", 0777}, // Symbolic link is unpacked as a file containing the target
+		}
+		for i, tt := range tests {
+			name := filepath.Join(dir, filepath.FromSlash(tt.file))
+			if got := readFile(t, name); got != tt.data {
+				t.Errorf("%s: #%d: want %q, got %q", file, i, tt.data, got)
+			}
+			fi, err := os.Lstat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != tt.mode {
+				t.Errorf("%s: #%d: want mode %o, got %o", file, i, tt.mode, got)
+			}
+			if want, got := 2020, fi.ModTime().Year(); want != got {
+				t.Errorf("%s: #%d: want mtime in %d, got %d", file, i, want, got)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "hardlink")); !os.IsNotExist(err) {
+			t.Errorf("%s: want hard link to be skipped", file)
+		}
+		if want, got := fmt.Sprintf("%s %s %s\n", archive, file, dir), readFile(t, out); want != got {
+			t.Errorf("%s: want post-command output %q, got %q", file, want, got)
+		}
+		if _, err := os.Lstat(archive); !os.IsNotExist(err) {
+			t.Errorf("%s: want archive to be removed", file)
+		}
+	}
+}
+
+func TestHandleLinks(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		archive = filepath.Join(dir, "test.tar.gz")
+	)
+	symlink(t, filepath.Join(testDir(t), "test.tar.gz"), archive)
+	h := NewHandler(Options{Options: unpack.Options{Symlinks: true}, HardLinks: true})
+	if err := h.Handle(context.Background(), archive, "", false); err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Readlink(filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "test1"; target != want {
+		t.Errorf("want link to %s, got %s", want, target)
+	}
+	a, err := os.Stat(filepath.Join(dir, "test1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(dir, "hardlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("want hard link to test1")
+	}
+}
+
+func TestHandleHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "links.tar")
+	writeTar(t, archive,
+		&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "./a"},
+		&tar.Header{Name: "c", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "d", Typeflag: tar.TypeLink, Linkname: "c"},
+		&tar.Header{Name: "e", Typeflag: tar.TypeLink, Linkname: "missing"})
+	h := NewHandler(Options{
+		Options:   unpack.Options{Overwrite: "rename", ExtractExclude: []string{"c"}},
+		HardLinks: true,
+	})
+	if err := h.Handle(context.Background(), archive, "", false); err != nil {
+		t.Fatal(err)
+	}
+	a, err := os.Stat(filepath.Join(dir, "a.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("want hard link to renamed target")
+	}
+	if want, got := "existing", readFile(t, filepath.Join(dir, "a")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	for _, name := range []string{"d", "e"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("want hard link %s to missing target to be skipped", name)
+		}
+	}
+}
+
+func TestHandleUnsafe(t *testing.T) {
+	var tests = []struct {
+		header *tar.Header
+		err    string
+	}{
+		{&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}, "unsafe entry: path traversal: ../evil"},
+		{&tar.Header{Name: "/evil", Typeflag: tar.TypeReg, Mode: 0644}, "unsafe entry: absolute path: /evil"},
+		{&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "../../evil"}, "unsafe entry: evil: symlink target outside "},
+		{&tar.Header{Name: "evil", Typeflag: tar.TypeLink, Linkname: "../evil"}, "unsafe entry: evil: path traversal: ../evil"},
+	}
+	for i, tt := range tests {
+		for _, skip := range []bool{false, true} {
+			root := t.TempDir()
+			dir := filepath.Join(root, "a")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(dir, "unsafe.tar")
+			writeTar(t, archive, tt.header, &tar.Header{Name: "ok", Typeflag: tar.TypeReg, Mode: 0644})
+
+			h := NewHandler(Options{Options: unpack.Options{SkipUnsafe: skip, Symlinks: true}, HardLinks: true})
+			err := h.Handle(context.Background(), archive, "", false)
+			if skip {
+				if err != nil {
+					t.Fatalf("#%d: %s", i, err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "ok")); err != nil {
+					t.Errorf("#%d: want safe entry to be unpacked: %s", i, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+			}
+			for _, name := range []string{filepath.Join(root, "evil"), filepath.Join(dir, "evil")} {
+				if _, err := os.Lstat(name); err == nil {
+					t.Errorf("#%d: unsafe entry unpacked to %s", i, name)
+				}
+			}
+		}
+	}
+}
+
+func TestHandleSymlinkAsFile(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "link.tar")
+	writeTar(t, archive, &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../../evil"})
+	// Without Symlinks, the target is only written as file contents, so it is not checked
+	if err := NewHandler(Options{}).Handle(context.Background(), archive, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "../../evil", readFile(t, filepath.Join(dir, "link")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestHandleSymlinkChain(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "chain.tar")
+	writeTar(t, archive,
+		&tar.Header{Name: "l1", Typeflag: tar.TypeSymlink, Linkname: "."},
+		&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "l1/l1/../.."})
+	h := NewHandler(Options{Options: unpack.Options{Symlinks: true}})
+	want := "unsafe entry: evil: symlink target outside "
+	if err := h.Handle(context.Background(), archive, "", false); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "evil")); err == nil {
+		t.Error("unsafe entry unpacked")
+	}
+}
+
+func TestHandleTruncated(t *testing.T) {
+	for _, file := range []string{"test.tar.gz", "test.tar.bz2", "test.tar.zst", "test.tar.xz"} {
+		var (
+			dir     = t.TempDir()
+			archive = filepath.Join(dir, file)
+			data    = readFile(t, filepath.Join(testDir(t), file))
+		)
+		if err := os.WriteFile(archive, []byte(data[:len(data)-10]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		h := NewHandler(Options{})
+		if err := h.Handle(context.Background(), archive, "", true); err == nil || !strings.HasPrefix(err.Error(), "unpacking failed: "+dir) {
+			t.Errorf("%s: want unpacking to fail, got %v", file, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "test1")); !os.IsNotExist(err) {
+			t.Errorf("%s: want no files to be unpacked", file)
+		}
+		if _, err := os.Stat(archive); err != nil {
+			t.Errorf("%s: want archive to be kept: %s", file, err)
+		}
+	}
+}
+
+func TestHandleNotTar(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "foo.nfo")
+	if err := os.WriteFile(name, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(Options{})
+	if err := h.Handle(context.Background(), name, "", false); err == nil || !strings.HasPrefix(err.Error(), "not a tar archive") {
+		t.Errorf("want error for non-tar file, got %v", err)
+	}
+}
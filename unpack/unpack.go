@@ -0,0 +1,515 @@
+// Package unpack implements the parts of unpacking that are shared by the archive handlers.
+package unpack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mpolden/sfv"
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/pathutil"
+	"github.com/mpolden/unp/progress"
+	"github.com/mpolden/unp/sfvutil"
+)
+
+const (
+	// PasswordFile is the name of an optional file, next to an archive, containing passwords to try.
+	PasswordFile = "password.txt"
+	// MaxLinkSize is the maximum size of a symbolic link target.
+	MaxLinkSize = 4096
+	// defaultMaxNesting is the default maximum depth of nested archives to unpack.
+	defaultMaxNesting = 8
+)
+
+// Options configures how an archive handler unpacks entries.
+type Options struct {
+	// SkipUnsafe skips entries that would be written outside the extraction directory. If false, such entries
+	// fail the whole set.
+	SkipUnsafe bool
+	// DestDir is a template for the directory to unpack archives to. It is rendered using the same data as
+	// post-commands. Relative directories are resolved against the archive directory. If empty, archives are
+	// unpacked next to the archive.
+	DestDir string
+	// Overwrite sets the policy for existing files that would be replaced by unpacked ones. See fsutil.OverwriteAlways
+	// and friends.
+	Overwrite string
+	// PreserveMode restores permission bits of files and directories stored in archives created on Unix systems.
+	PreserveMode bool
+	// Symlinks unpacks symbolic links as links. If false, symbolic links are unpacked as regular files containing
+	// the link target.
+	Symlinks bool
+	// ExtractInclude is a list of patterns matching entries to unpack. If empty, all entries are unpacked. See
+	// pathutil.Match for the pattern syntax.
+	ExtractInclude []string
+	// ExtractExclude is a list of patterns matching entries to skip.
+	ExtractExclude []string
+	// Passwords is a list of passwords to try when unpacking encrypted archives.
+	Passwords []string
+	// PasswordFile is the path to a file containing additional passwords to try, one per line.
+	PasswordFile string
+	// ReserveSpace is the number of bytes to keep free on the file system of the destination directory. A set is only
+	// unpacked if its unpacked size fits in the remaining space.
+	ReserveSpace int64
+	// MaxNesting is the maximum depth of nested archives to unpack. Archives nested deeper than this are left as is.
+	// If zero, defaultMaxNesting is used. If negative, nested archives are never unpacked. Volumes of nested archives
+	// are unpacked regardless of ExtractInclude, unless nested archives are never unpacked.
+	MaxNesting int
+	// RemoveNested removes the volumes of nested archives after they have been unpacked.
+	RemoveNested bool
+}
+
+// VerifyOptions configures how a handler verifies sets against their checksum files.
+type VerifyOptions struct {
+	// CacheFile is the path to a file where verified checksums are stored, so that they survive restarts. If empty,
+	// verified checksums are only kept in memory.
+	CacheFile string
+	// CacheTTL is the duration a verified checksum is kept for when it is not used. See sfvutil.NewCache for the
+	// default.
+	CacheTTL time.Duration
+	// CacheSize is the maximum number of verified checksums to keep. See sfvutil.NewCache for the default.
+	CacheSize int
+	// VerifyWorkers is the number of files to verify concurrently. If zero, GOMAXPROCS is used.
+	VerifyWorkers int
+}
+
+// Dest returns the directory to unpack the archive described by cd to.
+func (o Options) Dest(cd executil.CommandData) (string, error) {
+	if o.DestDir == "" {
+		return cd.Dir, nil
+	}
+	dir, err := executil.Expand(o.DestDir, cd)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(cd.Dir, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// MatchAny returns whether name matches any of patterns.
+func MatchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := pathutil.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Skip returns whether the entry name should be skipped according to the include and exclude patterns.
+func (o Options) Skip(name string) bool {
+	if MatchAny(o.ExtractExclude, name) {
+		return true
+	}
+	return len(o.ExtractInclude) > 0 && !MatchAny(o.ExtractInclude, name)
+}
+
+// SkipNested is like Skip, but volumes of nested archives, as recognised by firstVolume, are only skipped if excluded,
+// or if nested archives are never unpacked.
+func (o Options) SkipNested(name string, firstVolume func(name string) (string, error)) bool {
+	if !o.Skip(name) {
+		return false
+	}
+	if MatchAny(o.ExtractExclude, name) {
+		return true
+	}
+	_, err := firstVolume(name)
+	return err != nil || o.MaxNesting < 0
+}
+
+// UnpackNested unpacks the archives formed by volumes, which were unpacked to dir from an archive at the given depth,
+// and returns files, the entries unpacked to dir, followed by the entries of the nested archives. Existing files in
+// dest, which is the directory that dir is eventually published to, are handled by unpack.
+//
+// firstVolume returns the first volume of the archive that a volume belongs to. Only archives whose first volume is
+// among volumes are unpacked, so that each archive is unpacked once. For each of them, unpack is called with the first
+// volume, the directory it is eventually published to and its nesting depth, and returns the entries it unpacked next
+// to the first volume.
+func (o Options) UnpackNested(ctx context.Context, dir, dest string, depth int, files []manifest.Entry, volumes []string,
+	firstVolume func(name string) (string, error),
+	unpack func(ctx context.Context, first, dest string, depth int) ([]manifest.Entry, error)) ([]manifest.Entry, error) {
+	maxNesting := o.MaxNesting
+	if maxNesting == 0 {
+		maxNesting = defaultMaxNesting
+	}
+	unpacked := make(map[string]bool, len(volumes))
+	for _, v := range volumes {
+		unpacked[v] = true
+	}
+	var firsts []string
+	sets := make(map[string][]string)
+	for _, v := range volumes {
+		first, _ := firstVolume(v)
+		if !unpacked[first] {
+			continue
+		}
+		if _, ok := sets[first]; !ok {
+			firsts = append(firsts, first)
+		}
+		sets[first] = append(sets[first], v)
+	}
+	var nested []manifest.Entry
+	removed := make(map[string]bool)
+	for _, first := range firsts {
+		rel, err := filepath.Rel(dir, first)
+		if err != nil {
+			return nil, err
+		}
+		if depth >= maxNesting {
+			log.Printf("not unpacking nested archive %s: maximum nesting depth reached", rel)
+			continue
+		}
+		entries, err := unpack(ctx, first, filepath.Join(dest, filepath.Dir(rel)), depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack nested archive %s: %w", rel, err)
+		}
+		for _, e := range entries {
+			e.Name = path.Join(filepath.ToSlash(filepath.Dir(rel)), e.Name)
+			nested = append(nested, e)
+		}
+		if !o.RemoveNested {
+			continue
+		}
+		for _, v := range sets[first] {
+			if err := os.Remove(v); err != nil {
+				return nil, err
+			}
+			rel, err := filepath.Rel(dir, v)
+			if err != nil {
+				return nil, err
+			}
+			removed[filepath.ToSlash(rel)] = true
+		}
+	}
+	// Forget nested archives that were removed after unpacking
+	var kept []manifest.Entry
+	for _, f := range files {
+		if !removed[f.Name] {
+			kept = append(kept, f)
+		}
+	}
+	return append(kept, nested...), nil
+}
+
+// Unsafe handles an entry in filename that failed a safety check with err. If unsafe entries are skipped, the entry is
+// logged and nil is returned.
+func (o Options) Unsafe(filename string, err error) error {
+	if o.SkipUnsafe {
+		log.Printf("skipping unsafe entry in %s: %s", filename, err)
+		return nil
+	}
+	return fmt.Errorf("unsafe entry: %w", err)
+}
+
+// Target returns where the entry, which is unpacked to name in dir and eventually published to dest, should be
+// written. The returned path differs from name if the entry is renamed by the overwrite policy, and is empty if the
+// entry should be skipped. The parent directory of the returned path is created.
+func (o Options) Target(dir, dest, name, entry string, mtime time.Time) (string, error) {
+	// Never write through a previously unpacked symbolic link, as it may resolve outside dir
+	if ok, err := fsutil.ContainsSymlink(dir, name); err != nil {
+		return "", err
+	} else if ok {
+		return "", fmt.Errorf("unsafe entry: %s: path contains symlink", entry)
+	}
+	published := filepath.Join(dest, entry)
+	target, err := fsutil.ResolveConflict(o.Overwrite, published, mtime)
+	if err != nil {
+		return "", err
+	}
+	if target == "" {
+		log.Printf("skipping %s: file exists: %s", entry, published)
+		return "", nil
+	}
+	if target != published {
+		log.Printf("renaming %s to %s: file exists", entry, target)
+		name = filepath.Join(filepath.Dir(name), filepath.Base(target))
+	}
+	// Files can come before their containing folders, ensure that parent is created
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// maxLinks is the maximum number of symbolic links followed when resolving a symbolic link target.
+const maxLinks = 255
+
+// CheckSymlink returns an error if the symbolic link name, with the given target, points outside of root. The target
+// is resolved through the symbolic links already created in root. Parent directory references must follow existing
+// directories, so that links created later cannot change where the target points.
+func CheckSymlink(root, name, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("symlink target outside %s: %s", root, target)
+	}
+	root = filepath.Clean(root)
+	rel, err := filepath.Rel(root, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	links := 0
+	if _, err := resolve(root, append(split(rel), split(target)...), &links); err != nil {
+		return fmt.Errorf("%w: %s", err, target)
+	}
+	return nil
+}
+
+func split(name string) []string { return strings.Split(filepath.ToSlash(name), "/") }
+
+// resolve resolves the path elems, relative to root, through the symbolic links in root. The resolved path is
+// returned, or the empty string if it does not exist yet. Links is the number of symbolic links followed so far.
+func resolve(root string, elems []string, links *int) (string, error) {
+	dir := root
+	for i, elem := range elems {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if dir == root {
+				return "", fmt.Errorf("symlink target outside %s", root)
+			}
+			dir = filepath.Dir(dir)
+			continue
+		}
+		next := filepath.Join(dir, elem)
+		fi, err := os.Lstat(next)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if *links++; *links > maxLinks {
+				return "", fmt.Errorf("too many levels of symlinks")
+			}
+			var target string
+			target, err = os.Readlink(next)
+			if err != nil {
+				return "", err
+			}
+			if filepath.IsAbs(target) {
+				return "", fmt.Errorf("symlink target outside %s", root)
+			}
+			rel, err := filepath.Rel(root, dir)
+			if err != nil {
+				return "", err
+			}
+			if next, err = resolve(root, append(split(rel), split(target)...), links); err != nil {
+				return "", err
+			}
+			if next == "" {
+				err = os.ErrNotExist
+			}
+		}
+		if err != nil {
+			// The remainder of the path may be created later, so its meaning is only fixed if it only descends
+			for _, elem := range elems[i+1:] {
+				if elem == ".." {
+					return "", fmt.Errorf("symlink target through missing path %s", next)
+				}
+			}
+			return "", nil
+		}
+		dir = next
+	}
+	return dir, nil
+}
+
+// Link creates name as either a symbolic link to symlinkTo, or a hard link to hardLinkTo. A symbolic link never
+// replaces an existing file, as that could change where previously checked links point.
+func Link(name, symlinkTo, hardLinkTo string) error {
+	if symlinkTo != "" {
+		return os.Symlink(symlinkTo, name)
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(hardLinkTo, name)
+}
+
+// Links maps the names of unpacked entries to the paths they were unpacked to, so that hard links can be resolved to
+// the file their target was actually written to.
+type Links map[string]string
+
+// entryKey returns the slash-separated, cleaned form of the entry name, which may use backslash separators.
+func entryKey(entry string) string { return path.Clean(strings.ReplaceAll(entry, `\`, "/")) }
+
+// Add records that entry was unpacked to name.
+func (l Links) Add(entry, name string) { l[entryKey(entry)] = name }
+
+// Target returns the path that the entry target was unpacked to, and whether it was unpacked.
+func (l Links) Target(target string) (string, bool) {
+	name, ok := l[entryKey(target)]
+	return name, ok
+}
+
+// contextReader is a reader that fails once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Reader returns a reader that reads from r, reports progress to ctx and fails once ctx is done.
+func Reader(ctx context.Context, r io.Reader) io.Reader {
+	return progress.Reader(ctx, &contextReader{ctx: ctx, r: r})
+}
+
+// Staged calls unpack with a new staging directory in dest, and publishes the staged files to dest if successful. The
+// returned entries describe the files as published, since files that appeared in dest while unpacking are handled
+// according to the overwrite policy.
+func (o Options) Staged(dest string, unpack func(dir string) ([]manifest.Entry, error)) ([]manifest.Entry, error) {
+	staging, err := fsutil.StagingDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	files, err := unpack(staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return nil, err
+	}
+	moved, err := fsutil.Publish(staging, dest, o.Overwrite)
+	if err != nil {
+		os.RemoveAll(staging)
+		return nil, fmt.Errorf("failed to publish %s: %w", staging, err)
+	}
+	published := files[:0]
+	for _, f := range files {
+		if name, ok := moved[f.Name]; ok {
+			if name == "" {
+				continue
+			}
+			f.Name = name
+		}
+		published = append(published, f)
+	}
+	return published, nil
+}
+
+func readPasswords(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var passwords []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			passwords = append(passwords, line)
+		}
+	}
+	return passwords, nil
+}
+
+// Passwords returns the passwords to try for archives in dir. These are the passwords in PasswordFile in dir, if any,
+// followed by passwords and the passwords in file, if file is not empty.
+func Passwords(dir string, passwords []string, file string) ([]string, error) {
+	all, err := readPasswords(filepath.Join(dir, PasswordFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	all = append(all, passwords...)
+	if file != "" {
+		fromFile, err := readPasswords(file)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, fromFile...)
+	}
+	return all, nil
+}
+
+// Set is a set of volumes forming an archive. The set is described by a SFV if one lists it.
+type Set struct {
+	Base    string
+	Dir     string
+	Name    string
+	SFV     *sfv.SFV
+	Volumes []string
+}
+
+// CommandData returns the data that templates are rendered with for this set.
+func (s Set) CommandData() executil.CommandData {
+	return executil.CommandData{Base: s.Base, Dir: s.Dir, Name: s.Name}
+}
+
+// Key returns a key identifying this set.
+func (s Set) Key() string {
+	if s.SFV != nil {
+		return s.SFV.Path
+	}
+	return s.Name
+}
+
+// Sources returns the files that this set consists of.
+func (s Set) Sources() []string {
+	if s.SFV == nil {
+		return s.Volumes
+	}
+	sources := []string{s.SFV.Path}
+	for _, c := range s.SFV.Checksums {
+		sources = append(sources, c.Path)
+	}
+	return sources
+}
+
+// Remove removes the files that this set consists of.
+func (s Set) Remove() error {
+	for _, name := range s.Sources() {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify verifies the files listed in the SFV of this set, if it has one, using cache.
+func (s Set) Verify(ctx context.Context, cache *sfvutil.Cache, workers int) error {
+	if s.SFV == nil {
+		return nil
+	}
+	passed, total, err := cache.Verify(ctx, s.SFV, workers)
+	SaveCache(cache)
+	if err != nil {
+		return fmt.Errorf("verification failed: %s: %w", s.Dir, err)
+	}
+	if passed != total {
+		return fmt.Errorf("incomplete: %s: %d/%d files", s.Dir, passed, total)
+	}
+	return nil
+}
+
+// Forget removes the verified checksums of this set, once it is complete, from cache.
+func (s Set) Forget(cache *sfvutil.Cache) {
+	if s.SFV == nil {
+		return
+	}
+	cache.Forget(s.SFV)
+	SaveCache(cache)
+}
+
+// LoadCache creates a verification cache and loads it from the cache file. See sfvutil.NewCache.
+func (o VerifyOptions) LoadCache() *sfvutil.Cache {
+	cache := sfvutil.NewCache(o.CacheFile, o.CacheTTL, o.CacheSize)
+	if err := cache.Load(); err != nil {
+		log.Printf("failed to load verification cache: %s", err)
+	}
+	return cache
+}
+
+// SaveCache saves cache, logging any error.
+func SaveCache(cache *sfvutil.Cache) {
+	if err := cache.Save(); err != nil {
+		log.Printf("failed to save verification cache: %s", err)
+	}
+}
@@ -0,0 +1,167 @@
+package unpack
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/manifest"
+)
+
+func TestDest(t *testing.T) {
+	cd := executil.CommandData{Base: "foo.rar", Dir: "/src", Name: "/src/foo.rar"}
+	var tests = []struct {
+		destDir string
+		out     string
+	}{
+		{"", "/src"},
+		{"/dst", "/dst"},
+		{"/dst/{{.Base}}/", "/dst/foo.rar"},
+		{"done", "/src/done"},
+		{"../done", "/done"},
+	}
+	for i, tt := range tests {
+		got, err := Options{DestDir: tt.destDir}.Dest(cd)
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if got != tt.out {
+			t.Errorf("#%d: want %s, got %s", i, tt.out, got)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	var tests = []struct {
+		opts Options
+		name string
+		out  bool
+	}{
+		{Options{}, "foo", false},
+		{Options{ExtractExclude: []string{"*.nfo"}}, "dir/foo.nfo", true},
+		{Options{ExtractExclude: []string{"*.nfo"}}, "foo.mkv", false},
+		{Options{ExtractInclude: []string{"*.mkv"}}, "foo.mkv", false},
+		{Options{ExtractInclude: []string{"*.mkv"}}, "foo.nfo", true},
+		{Options{ExtractInclude: []string{"*.mkv"}, ExtractExclude: []string{"sample/"}}, "sample/foo.mkv", true},
+	}
+	for i, tt := range tests {
+		if got := tt.opts.Skip(tt.name); got != tt.out {
+			t.Errorf("#%d: want %t, got %t for %s", i, tt.out, got, tt.name)
+		}
+	}
+}
+
+func TestStaged(t *testing.T) {
+	dest := t.TempDir()
+	files, err := Options{Overwrite: "rename"}.Staged(dest, func(dir string) ([]manifest.Entry, error) {
+		if err := os.WriteFile(filepath.Join(dir, "a"), []byte("new"), 0644); err != nil {
+			return nil, err
+		}
+		// A file appears in dest while unpacking
+		if err := os.WriteFile(filepath.Join(dest, "a"), []byte("old"), 0644); err != nil {
+			return nil, err
+		}
+		return []manifest.Entry{{Name: "a", Size: 3}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []manifest.Entry{{Name: "a.1", Size: 3}}; !reflect.DeepEqual(want, files) {
+		t.Errorf("want %v, got %v", want, files)
+	}
+	for name, want := range map[string]string{"a": "old", "a.1": "new"} {
+		if data, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(data) != want {
+			t.Errorf("want %q in %s, got %q (%v)", want, name, data, err)
+		}
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PasswordFile), []byte("a\r\n\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "passwords")
+	if err := os.WriteFile(file, []byte("d\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Passwords(dir, []string{"c"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if _, err := Passwords(dir, nil, filepath.Join(dir, "missing")); err == nil {
+		t.Error("want error for missing password file")
+	}
+}
+
+func TestCheckSymlink(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", filepath.Join(root, "l1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(root, "l3")); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name   string
+		target string
+		err    string
+	}{
+		{"l2", "a", ""},
+		{"l2", "l1/l1/a", ""},
+		{"a/l2", "../l3/foo", ""},
+		{"l2", "l3/..", ""},
+		{"l2", "missing/file", ""},
+		{"l2", "/etc/passwd", "symlink target outside " + root + ": /etc/passwd"},
+		{"a/l2", "../../evil", "symlink target outside " + root + ": ../../evil"},
+		{"l2", "l1/l1/../../..", "symlink target outside " + root + ": l1/l1/../../.."},
+		{"l2", "l1/l1/../..", "symlink target outside " + root + ": l1/l1/../.."},
+		{"a/l2", "../l1/..", "symlink target outside " + root + ": ../l1/.."},
+		{"l2", "missing/..", "symlink target through missing path " + filepath.Join(root, "missing") + ": missing/.."},
+	}
+	for i, tt := range tests {
+		err := CheckSymlink(root, filepath.Join(root, tt.name), tt.target)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("#%d: %s", i, err)
+			}
+		} else if err == nil || err.Error() != tt.err {
+			t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "link")
+	if err := Link(name, "foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(name, ".", ""); err == nil {
+		t.Error("want error when replacing existing file with symlink")
+	}
+	if target, err := os.Readlink(name); err != nil || target != "foo" {
+		t.Errorf("want link to foo, got %q (%v)", target, err)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	links := make(Links)
+	links.Add(`dir\a`, "/staging/dir/a.1")
+	for _, target := range []string{"dir/a", "./dir/a", `dir\a`, "dir//a"} {
+		if got, ok := links.Target(target); !ok || got != "/staging/dir/a.1" {
+			t.Errorf("want %s to resolve to renamed file, got %q", target, got)
+		}
+	}
+	if _, ok := links.Target("dir/b"); ok {
+		t.Error("want missing target to not resolve")
+	}
+}
@@ -0,0 +1,126 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/sfvutil"
+	"github.com/mpolden/unp/syncutil"
+	"github.com/mpolden/unp/unpack"
+)
+
+// Options configures how a Handler verifies files.
+type Options struct {
+	unpack.VerifyOptions
+}
+
+// Handler verifies sets of files listed in checksum files, such as SFVs, and runs the post-process command once all
+// files of a set are present and intact.
+type Handler struct {
+	locks syncutil.KeyMutex
+	cache *sfvutil.Cache
+	opts  Options
+}
+
+func NewHandler(opts Options) *Handler {
+	return &Handler{cache: opts.LoadCache(), opts: opts}
+}
+
+// Close stops pruning the verification cache of the handler.
+func (h *Handler) Close() { h.cache.Close() }
+
+// find returns the checksum list in lists describing the set that filename belongs to. A file belongs to a set if it
+// is the checksum file itself, or if it is listed in it. Other files belong to the only set in their directory, if
+// there is exactly one.
+func find(filename string, lists []*sfvutil.List) *sfvutil.List {
+	filename = filepath.Clean(filename)
+	for _, l := range lists {
+		if filepath.Clean(l.Path) == filename {
+			return l
+		}
+		for _, c := range l.Checksums {
+			if filepath.Clean(c.Path) == filename {
+				return l
+			}
+		}
+	}
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	return nil
+}
+
+// listFor returns the checksum list describing the set that filename belongs to.
+func listFor(filename string) (*sfvutil.List, error) {
+	dir := filepath.Dir(filename)
+	lists, err := sfvutil.ReadLists(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := find(filename, lists)
+	if l == nil {
+		if len(lists) == 0 {
+			return nil, fmt.Errorf("no checksum file found in %s", dir)
+		}
+		return nil, fmt.Errorf("no checksum file found for %s", filename)
+	}
+	return l, nil
+}
+
+func paths(l *sfvutil.List) []string {
+	paths := make([]string, 0, len(l.Checksums))
+	for _, c := range l.Checksums {
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+// Handle verifies the set that name belongs to, and runs postCommand once all its files are present and intact. If
+// remove is true, the checksum file of the set is removed once the set is verified, while the verified files are kept.
+// Later events for the verified files are then ignored, as long as the files are unchanged.
+func (h *Handler) Handle(ctx context.Context, name, postCommand string, remove bool) error {
+	l, err := listFor(name)
+	if err != nil {
+		if manifest.Contains(filepath.Dir(name), name) {
+			return nil
+		}
+		return err
+	}
+	defer h.locks.Lock(l.Path)()
+	dir := filepath.Dir(l.Path)
+	if manifest.Unpacked(ctx, dir, l.Path) {
+		return nil
+	}
+	passed, total, err := h.cache.VerifyList(ctx, l, h.opts.VerifyWorkers)
+	unpack.SaveCache(h.cache)
+	if err != nil {
+		return fmt.Errorf("verification failed: %s: %w", dir, err)
+	}
+	if total == 0 {
+		return fmt.Errorf("verification failed: %s: no checksums found in %s", dir, l.Path)
+	}
+	if passed != total {
+		return fmt.Errorf("incomplete: %s: %d/%d files", dir, passed, total)
+	}
+	// The verified files are recorded as the volumes of the set, so that the set is verified again if they change
+	if err := manifest.Record(dir, l.Path, paths(l), nil); err != nil {
+		log.Printf("failed to write manifest: %s: %s", dir, err)
+	}
+	h.cache.ForgetList(l)
+	unpack.SaveCache(h.cache)
+	if remove {
+		if err := os.Remove(l.Path); err != nil {
+			return fmt.Errorf("removal failed: %s: %w", dir, err)
+		}
+	}
+	cd := executil.CommandData{Base: filepath.Base(l.Path), Dir: dir, Name: l.Path}
+	if err := executil.Run(ctx, postCommand, cd); err != nil {
+		return fmt.Errorf("post-process command failed: %s: %w", dir, err)
+	}
+	return nil
+}
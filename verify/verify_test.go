@@ -0,0 +1,151 @@
+package verify
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpolden/unp/manifest"
+)
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+var files = map[string]string{"foo.mkv": "foo", "bar.mkv": "bar"}
+
+func TestHandle(t *testing.T) {
+	var tests = []struct {
+		list string
+		line func(name, data string) string
+	}{
+		{"test.sfv", func(name, data string) string { return fmt.Sprintf("%s %08x", name, crc32.ChecksumIEEE([]byte(data))) }},
+		{"test.md5", func(name, data string) string { return fmt.Sprintf("%x  %s", md5.Sum([]byte(data)), name) }},
+		{"test.sha256", func(name, data string) string { return fmt.Sprintf("%x *%s", sha256.Sum256([]byte(data)), name) }},
+	}
+	for i, tt := range tests {
+		var (
+			dir    = t.TempDir()
+			list   = filepath.Join(dir, tt.list)
+			out    = filepath.Join(t.TempDir(), "post")
+			script = filepath.Join(t.TempDir(), "post.sh")
+			lines  []string
+		)
+		for name, data := range files {
+			lines = append(lines, tt.line(name, data))
+		}
+		writeFile(t, list, strings.Join(lines, "\n")+"\n")
+		writeFile(t, script, "#!/bin/sh\necho \"$@\" > "+out+"\n")
+		if err := os.Chmod(script, 0755); err != nil {
+			t.Fatal(err)
+		}
+		post := script + " {{.Name}} {{.Base}} {{.Dir}}"
+		h := NewHandler(Options{})
+
+		// Set is incomplete until every file exists and matches
+		foo := filepath.Join(dir, "foo.mkv")
+		writeFile(t, foo, files["foo.mkv"])
+		bar := filepath.Join(dir, "bar.mkv")
+		writeFile(t, bar, "corrupt")
+		want := "incomplete: " + dir + ": 1/2 files"
+		if err := h.Handle(context.Background(), foo, post, true); err == nil || err.Error() != want {
+			t.Errorf("#%d: want err = %q, got %v", i, want, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("#%d: want post-command to not run", i)
+		}
+		if want, got := 1, h.cache.Len(); want != got {
+			t.Errorf("#%d: want %d cache entries, got %d", i, want, got)
+		}
+
+		writeFile(t, bar, files["bar.mkv"])
+		if err := h.Handle(context.Background(), bar, post, true); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if want, got := fmt.Sprintf("%s %s %s\n", list, tt.list, dir), readFile(t, out); want != got {
+			t.Errorf("#%d: want post-command output %q, got %q", i, want, got)
+		}
+		if want, got := 0, h.cache.Len(); want != got {
+			t.Errorf("#%d: want %d cache entries, got %d", i, want, got)
+		}
+		if _, err := os.Stat(list); !os.IsNotExist(err) {
+			t.Errorf("#%d: want %s to be removed", i, list)
+		}
+		for _, name := range []string{foo, bar} {
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("#%d: want %s to be kept: %s", i, name, err)
+			}
+		}
+
+		// Verified files are ignored once their checksum file is removed, until they change
+		os.Remove(out)
+		if err := h.Handle(context.Background(), foo, post, true); err != nil {
+			t.Errorf("#%d: want no error for verified file, got %s", i, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("#%d: want post-command to not run again", i)
+		}
+		writeFile(t, foo, "changed")
+		if err := h.Handle(context.Background(), foo, post, true); err == nil {
+			t.Errorf("#%d: want error for changed file without checksum file", i)
+		}
+	}
+}
+
+func TestHandleOnce(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		list = filepath.Join(dir, "test.md5")
+		out  = filepath.Join(t.TempDir(), "post")
+	)
+	writeFile(t, filepath.Join(dir, "foo.mkv"), "foo")
+	writeFile(t, list, fmt.Sprintf("%x  foo.mkv\n", md5.Sum([]byte("foo"))))
+	script := filepath.Join(t.TempDir(), "post.sh")
+	writeFile(t, script, "#!/bin/sh\necho run >> "+out+"\n")
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(Options{})
+	for i := 0; i < 2; i++ {
+		if err := h.Handle(context.Background(), list, script, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, got := "run\n", readFile(t, out); want != got {
+		t.Errorf("want post-command to run once, got %q", got)
+	}
+	if err := h.Handle(manifest.WithForce(context.Background()), list, script, false); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "run\nrun\n", readFile(t, out); want != got {
+		t.Errorf("want post-command to run again when forced, got %q", got)
+	}
+}
+
+func TestHandleNoList(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "foo.mkv")
+	writeFile(t, name, "foo")
+	want := "no checksum file found in " + dir
+	if err := NewHandler(Options{}).Handle(context.Background(), name, "", false); err == nil || err.Error() != want {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+}
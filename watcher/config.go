@@ -8,28 +8,63 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/par2"
+	"github.com/mpolden/unp/pathutil"
 	"github.com/mpolden/unp/rar"
+	"github.com/mpolden/unp/sevenzip"
+	"github.com/mpolden/unp/tar"
+	"github.com/mpolden/unp/unpack"
+	"github.com/mpolden/unp/verify"
+	"github.com/mpolden/unp/zip"
 )
 
 type Config struct {
-	Default    Path
-	BufferSize int
-	Paths      []Path
-	filename   string
+	Default          Path
+	BufferSize       int
+	RetryDelay       int
+	ProgressInterval int
+	Workers          int
+	Paths            []Path
+	filename         string
 }
 
 type Path struct {
-	Name        string
-	Handler     string
-	handler     Handler
-	MaxDepth    int
-	MinDepth    int
-	SkipHidden  bool
-	Patterns    []string
-	Remove      bool
-	PostCommand string
+	Name           string
+	Handler        string
+	handler        Handler
+	MaxDepth       int
+	MinDepth       int
+	SkipHidden     bool
+	Patterns       []string
+	Remove         bool
+	PostCommand    string
+	SkipUnsafe     bool
+	DestDir        string
+	Passwords      []string
+	PasswordFile   string
+	Completeness   string
+	Overwrite      string
+	PreserveMode   bool
+	Symlinks       bool
+	HardLinks      bool
+	ReserveSpace   int64
+	MaxNesting     int
+	RemoveNested   bool
+	CacheFile      string
+	CacheTTL       int
+	CacheSize      int
+	Timeout        int
+	VerifyWorkers  int
+	ExtractInclude []string
+	ExtractExclude []string
+	Par2           bool
+	Par2Delay      int
 }
 
 func (p *Path) match(name string) (bool, error) {
@@ -49,6 +84,47 @@ func (p *Path) validDepth(depth int) bool {
 	return depth >= p.MinDepth && depth <= p.MaxDepth
 }
 
+// stagingRoots returns the directories that may contain staging directories created by handlers of this path.
+func (p *Path) stagingRoots() []string {
+	roots := []string{p.Name}
+	dir := p.DestDir
+	if i := strings.Index(dir, "{{"); i >= 0 {
+		dir = filepath.Dir(dir[:i])
+	}
+	if filepath.IsAbs(dir) {
+		roots = append(roots, dir)
+	}
+	return roots
+}
+
+// unpackOptions returns the options shared by the archive handlers of this path.
+func (p *Path) unpackOptions() unpack.Options {
+	return unpack.Options{
+		SkipUnsafe:     p.SkipUnsafe,
+		DestDir:        p.DestDir,
+		Overwrite:      p.Overwrite,
+		PreserveMode:   p.PreserveMode,
+		Symlinks:       p.Symlinks,
+		ExtractInclude: p.ExtractInclude,
+		ExtractExclude: p.ExtractExclude,
+		Passwords:      p.Passwords,
+		PasswordFile:   p.PasswordFile,
+		ReserveSpace:   p.ReserveSpace,
+		MaxNesting:     p.MaxNesting,
+		RemoveNested:   p.RemoveNested,
+	}
+}
+
+// verifyOptions returns the options shared by the handlers of this path that verify sets.
+func (p *Path) verifyOptions() unpack.VerifyOptions {
+	return unpack.VerifyOptions{
+		CacheFile:     p.CacheFile,
+		CacheTTL:      time.Duration(p.CacheTTL) * time.Second,
+		CacheSize:     p.CacheSize,
+		VerifyWorkers: p.VerifyWorkers,
+	}
+}
+
 func readConfig(r io.Reader) (Config, error) {
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -67,16 +143,42 @@ func readConfig(r io.Reader) (Config, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return Config{}, err
 	}
+	// A cache file set in the default path is shared by every path, so give each path its own
+	for i, p := range cfg.Paths {
+		if p.CacheFile != "" && p.CacheFile == defaults.Default.CacheFile {
+			cfg.Paths[i].CacheFile = pathCacheFile(p.CacheFile, p.Name)
+		}
+	}
 	// Set a default buffer size
 	if cfg.BufferSize <= 0 {
 		cfg.BufferSize = 1024
 	}
+	// Set a default retry delay
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = 300
+	}
+	// Set a default progress interval
+	if cfg.ProgressInterval == 0 {
+		cfg.ProgressInterval = 60
+	}
+	// Set a default number of workers
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
 	if err := cfg.load(); err != nil {
 		return Config{}, err
 	}
 	return cfg, nil
 }
 
+// pathCacheFile returns the name of the cache file for the path name, derived from the shared cache file filename. The
+// path is appended to the base name, e.g. /cache/unp.json becomes /cache/unp-media-videos.json for /media/videos.
+func pathCacheFile(filename, name string) string {
+	ext := filepath.Ext(filename)
+	suffix := strings.ReplaceAll(strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/"), "/", "-")
+	return strings.TrimSuffix(filename, ext) + "-" + suffix + ext
+}
+
 func ReadConfig(name string) (Config, error) {
 	if name == "~/.unprc" {
 		home := os.Getenv("HOME")
@@ -105,11 +207,34 @@ func isExecutable(s string) error {
 	return err
 }
 
+// par2Delay returns the duration the files of a set must be left unchanged before it is repaired. The default is one
+// minute.
+func (p *Path) par2Delay() time.Duration {
+	if p.Par2Delay == 0 {
+		return time.Minute
+	}
+	return time.Duration(p.Par2Delay) * time.Second
+}
+
+func (p Path) redacted() Path {
+	if len(p.Passwords) > 0 {
+		p.Passwords = []string{"<redacted>"}
+	}
+	return p
+}
+
 func (c *Config) JSON() ([]byte, error) {
-	return json.MarshalIndent(c, "", "  ")
+	cfg := *c
+	cfg.Default = c.Default.redacted()
+	cfg.Paths = make([]Path, len(c.Paths))
+	for i, p := range c.Paths {
+		cfg.Paths[i] = p.redacted()
+	}
+	return json.MarshalIndent(cfg, "", "  ")
 }
 
 func (c *Config) load() error {
+	cacheFiles := make(map[string]bool)
 	for i, p := range c.Paths {
 		fi, err := os.Stat(p.Name)
 		if err != nil {
@@ -127,9 +252,55 @@ func (c *Config) load() error {
 		if err := isExecutable(p.PostCommand); err != nil {
 			return err
 		}
+		if _, err := executil.Expand(p.DestDir, executil.CommandData{}); err != nil {
+			return fmt.Errorf("invalid destination: %w", err)
+		}
+		switch p.Completeness {
+		case "", rar.CompletenessSFV, rar.CompletenessHeaders, rar.CompletenessAuto:
+		default:
+			return fmt.Errorf("invalid completeness: %q", p.Completeness)
+		}
+		for _, pattern := range append(p.ExtractInclude, p.ExtractExclude...) {
+			if _, err := pathutil.Match(pattern, "foo"); err != nil {
+				return fmt.Errorf("invalid extract pattern: %q: %w", pattern, err)
+			}
+		}
+		if p.Timeout < 0 {
+			return fmt.Errorf("timeout must be >= 0")
+		}
+		if p.ReserveSpace < 0 {
+			return fmt.Errorf("reserve space must be >= 0")
+		}
+		if !fsutil.IsOverwritePolicy(p.Overwrite) {
+			return fmt.Errorf("invalid overwrite policy: %q", p.Overwrite)
+		}
+		if p.CacheFile != "" {
+			if cacheFiles[p.CacheFile] {
+				return fmt.Errorf("cache file used by multiple paths: %s", p.CacheFile)
+			}
+			cacheFiles[p.CacheFile] = true
+		}
+		opts, verifyOpts := p.unpackOptions(), p.verifyOptions()
 		switch p.Handler {
 		case "rar", "":
-			c.Paths[i].handler = rar.NewHandler()
+			c.Paths[i].handler = rar.NewHandler(rar.Options{
+				Options:       opts,
+				VerifyOptions: verifyOpts,
+				Completeness:  p.Completeness,
+				HardLinks:     p.HardLinks,
+				Par2:          p.Par2,
+				Par2Delay:     p.par2Delay(),
+			})
+		case "zip":
+			c.Paths[i].handler = zip.NewHandler(zip.Options{Options: opts, VerifyOptions: verifyOpts})
+		case "tar":
+			c.Paths[i].handler = tar.NewHandler(tar.Options{Options: opts, HardLinks: p.HardLinks})
+		case "7z":
+			c.Paths[i].handler = sevenzip.NewHandler(sevenzip.Options{Options: opts, VerifyOptions: verifyOpts})
+		case "par2":
+			c.Paths[i].handler = par2.NewHandler(par2.Options{Delay: p.par2Delay()})
+		case "verify":
+			c.Paths[i].handler = verify.NewHandler(verify.Options{VerifyOptions: verifyOpts})
 		case "script":
 			c.Paths[i].handler = &scriptHandler{}
 		default:
@@ -139,6 +310,15 @@ func (c *Config) load() error {
 	return nil
 }
 
+// close releases the resources held by the handlers of this config, once it has been replaced.
+func (c *Config) close() {
+	for _, p := range c.Paths {
+		if h, ok := p.handler.(interface{ Close() }); ok {
+			h.Close()
+		}
+	}
+}
+
 func (c *Config) findPath(prefix string) (Path, bool) {
 	for _, p := range c.Paths {
 		if strings.HasPrefix(prefix, p.Name) {
@@ -2,6 +2,7 @@ package watcher
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -108,3 +109,79 @@ func TestValidDepth(t *testing.T) {
 		}
 	}
 }
+
+func TestStagingRoots(t *testing.T) {
+	var tests = []struct {
+		destDir string
+		out     []string
+	}{
+		{"", []string{"/foo"}},
+		{"unpacked", []string{"/foo"}},
+		{"/media/unpacked", []string{"/foo", "/media/unpacked"}},
+		{"/media/unpacked/{{.Base}}", []string{"/foo", "/media/unpacked"}},
+		{"/media/unpacked-{{.Base}}", []string{"/foo", "/media"}},
+		{"{{.Dir}}/unpacked", []string{"/foo"}},
+	}
+	for _, tt := range tests {
+		p := Path{Name: "/foo", DestDir: tt.destDir}
+		if got := p.stagingRoots(); !reflect.DeepEqual(got, tt.out) {
+			t.Errorf("want %q, got %q for %q", tt.out, got, tt.destDir)
+		}
+	}
+}
+
+func TestJSONRedactsPasswords(t *testing.T) {
+	c := Config{
+		Default: Path{Passwords: []string{"secret1"}},
+		Paths:   []Path{{Name: "/foo", Passwords: []string{"secret2", "secret3"}}},
+	}
+	data, err := c.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("want passwords to be redacted, got %s", data)
+	}
+	if want, got := "secret2", c.Paths[0].Passwords[0]; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestReadConfigCacheFile(t *testing.T) {
+	path1 := t.TempDir()
+	path2 := t.TempDir()
+	path3 := t.TempDir()
+	jsonConfig := fmt.Sprintf(`
+{
+  "Default": {
+    "CacheFile": "/cache/unp.json"
+  },
+  "Paths": [
+    {
+      "Name": "%s"
+    },
+    {
+      "Name": "%s"
+    },
+    {
+      "Name": "%s",
+      "CacheFile": "/cache/other.json"
+    }
+  ]
+}
+`, path1, path2, path3)
+	cfg, err := readConfig(strings.NewReader(jsonConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paths using the default cache file get their own
+	for i, want := range []string{
+		"/cache/unp-" + strings.ReplaceAll(strings.Trim(path1, "/"), "/", "-") + ".json",
+		"/cache/unp-" + strings.ReplaceAll(strings.Trim(path2, "/"), "/", "-") + ".json",
+		"/cache/other.json",
+	} {
+		if got := cfg.Paths[i].CacheFile; got != want {
+			t.Errorf("#%d: want CacheFile=%q, got %q", i, want, got)
+		}
+	}
+}
@@ -1,49 +1,79 @@
 package watcher
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
+	"sort"
 	"sync"
 	"syscall"
+	"time"
 
 	"path/filepath"
 
 	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/manifest"
 	"github.com/mpolden/unp/pathutil"
+	"github.com/mpolden/unp/progress"
 	"github.com/rjeczalik/notify"
 )
 
 type Handler interface {
-	Handle(filename, postCommand string, remove bool) error
+	Handle(ctx context.Context, filename, postCommand string, remove bool) error
 }
 
-type scriptHandler struct{}
+// scriptHandler runs post-commands one at a time.
+type scriptHandler struct{ mu sync.Mutex }
 
-func (h *scriptHandler) Handle(filename, postCommand string, remove bool) error {
+func (h *scriptHandler) Handle(ctx context.Context, filename, postCommand string, remove bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	data := executil.CommandData{
 		Dir:  filepath.Dir(filename),
 		Base: filepath.Base(filename),
 		Name: filename,
 	}
-	return executil.Run(postCommand, data)
+	return executil.Run(ctx, postCommand, data)
 }
 
+type retryEvent struct{ path string }
+
+func (e retryEvent) Event() notify.Event { return notifyFlag }
+func (e retryEvent) Path() string        { return e.path }
+func (e retryEvent) Sys() interface{}    { return nil }
+
 type Watcher struct {
-	config Config
-	events chan notify.EventInfo
-	signal chan os.Signal
-	done   chan bool
-	mu     sync.Mutex
-	wg     sync.WaitGroup
+	config     Config
+	events     chan notify.EventInfo
+	queue      chan string
+	workers    int
+	signal     chan os.Signal
+	done       chan bool
+	mu         sync.RWMutex
+	wg         sync.WaitGroup
+	retryDelay time.Duration
+	retryMu    sync.Mutex
+	retries    map[string]*time.Timer
+	ctx        context.Context
+	cancel     context.CancelFunc
+	progressMu sync.Mutex
+	progress   map[string]progress.Progress
 }
 
-func (w *Watcher) handle(name string) error {
+func (w *Watcher) handle(ctx context.Context, name string) error {
 	p, ok := w.config.findPath(name)
 	if !ok {
 		return fmt.Errorf("no configured path found: %s", name)
 	}
+	// Files being unpacked by a handler are not events of their own
+	if fsutil.InStaging(name) {
+		return fmt.Errorf("staging path: %s", name)
+	}
 	if p.SkipHidden && pathutil.ContainsHidden(name) {
 		return fmt.Errorf("hidden parent dir or file: %s", name)
 	}
@@ -58,7 +88,82 @@ func (w *Watcher) handle(name string) error {
 		}
 		return fmt.Errorf("no match found: %s", name)
 	}
-	return p.handler.Handle(name, p.PostCommand, p.Remove)
+	fn, done := w.trackProgress()
+	defer done()
+	ctx = progress.WithFunc(ctx, fn)
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(p.Timeout)*time.Second)
+		defer cancel()
+	}
+	return p.handler.Handle(ctx, name, p.PostCommand, p.Remove)
+}
+
+// trackProgress returns a progress function that records progress of a handler, and logs it at the configured
+// interval. The returned done function forgets the recorded progress.
+func (w *Watcher) trackProgress() (progress.Func, func()) {
+	interval := time.Duration(w.config.ProgressInterval) * time.Second
+	logged := make(map[string]time.Time)
+	fn := func(p progress.Progress) {
+		w.progressMu.Lock()
+		defer w.progressMu.Unlock()
+		w.progress[p.Name] = p
+		last, ok := logged[p.Name]
+		if !ok {
+			logged[p.Name] = time.Now()
+		} else if interval > 0 && time.Since(last) >= interval {
+			log.Printf("unpacking %s", p)
+			logged[p.Name] = time.Now()
+		}
+	}
+	done := func() {
+		w.progressMu.Lock()
+		defer w.progressMu.Unlock()
+		for name := range logged {
+			delete(w.progress, name)
+		}
+	}
+	return fn, done
+}
+
+// Progress returns the progress of all archives currently being unpacked.
+func (w *Watcher) Progress() []progress.Progress {
+	w.progressMu.Lock()
+	defer w.progressMu.Unlock()
+	ps := make([]progress.Progress, 0, len(w.progress))
+	for _, p := range w.progress {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	return ps
+}
+
+func (w *Watcher) retry(name string) {
+	w.retryMu.Lock()
+	defer w.retryMu.Unlock()
+	if _, ok := w.retries[name]; ok {
+		return
+	}
+	log.Printf("retrying %s in %s", name, w.retryDelay)
+	w.retries[name] = time.AfterFunc(w.retryDelay, func() {
+		w.retryMu.Lock()
+		delete(w.retries, name)
+		w.retryMu.Unlock()
+		select {
+		case w.events <- retryEvent{name}:
+		default:
+			log.Printf("failed to retry %s: event buffer is full", name)
+		}
+	})
+}
+
+func (w *Watcher) stopRetries() {
+	w.retryMu.Lock()
+	defer w.retryMu.Unlock()
+	for name, t := range w.retries {
+		t.Stop()
+		delete(w.retries, name)
+	}
 }
 
 func (w *Watcher) watch() {
@@ -72,10 +177,25 @@ func (w *Watcher) watch() {
 	}
 }
 
+func (w *Watcher) cleanup() {
+	for _, p := range w.config.Paths {
+		for _, root := range p.stagingRoots() {
+			removed, err := fsutil.RemoveStaging(root)
+			if err != nil {
+				log.Printf("failed to clean up %s: %s", root, err)
+			}
+			for _, dir := range removed {
+				log.Printf("removed leftover staging directory %s", dir)
+			}
+		}
+	}
+}
+
 func (w *Watcher) reload() {
 	cfg, err := ReadConfig(w.config.filename)
 	if err == nil {
 		notify.Stop(w.events)
+		w.config.close()
 		w.config = cfg
 		w.watch()
 	} else {
@@ -83,34 +203,58 @@ func (w *Watcher) reload() {
 	}
 }
 
+// scan handles every regular file in root, which may also be a single file.
+func (w *Watcher) scan(ctx context.Context, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info == nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := w.handle(ctx, path); err != nil {
+			log.Print(err)
+		}
+		return nil
+	})
+}
+
 func (w *Watcher) rescan() {
 	for _, p := range w.config.Paths {
-		err := filepath.Walk(p.Name, func(path string, info os.FileInfo, err error) error {
-			if os.IsNotExist(err) {
-				return nil
-			} else if err != nil {
-				return err
-			}
-			if info == nil || !info.Mode().IsRegular() {
-				return nil
-			}
-			if err := w.handle(path); err != nil {
-				log.Print(err)
-			}
-			return nil
-		})
-		if err != nil {
+		if err := w.scan(w.ctx, p.Name); err != nil {
 			log.Printf("failed to rescan %s: %s", p.Name, err)
 		}
 	}
 }
 
+// Force handles the files in names once, unpacking sets again even if they have already been unpacked. Directories
+// in names are walked recursively.
+func (w *Watcher) Force(ctx context.Context, names ...string) error {
+	ctx = manifest.WithForce(ctx)
+	for _, name := range names {
+		path, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+		if err := w.scan(ctx, path); err != nil {
+			return fmt.Errorf("failed to scan %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
 func (w *Watcher) readSignal() {
 	for {
 		select {
 		case <-w.done:
 			return
 		case s := <-w.signal:
+			if s == syscall.SIGTERM || s == syscall.SIGINT {
+				// Interrupt any running handler, instead of waiting for it to complete
+				w.cancel()
+			}
 			w.mu.Lock()
 			switch s {
 			case syscall.SIGUSR1:
@@ -129,22 +273,37 @@ func (w *Watcher) readSignal() {
 }
 
 func (w *Watcher) readEvent() {
+	defer close(w.queue)
 	for {
 		select {
 		case <-w.done:
 			return
 		case ev := <-w.events:
-			w.mu.Lock()
-			if err := w.handle(ev.Path()); err != nil {
-				log.Print(err)
+			select {
+			case w.queue <- ev.Path():
+			case <-w.done:
+				return
 			}
-			w.mu.Unlock()
 		}
 	}
 }
 
+// work handles queued events until the queue is closed. Handlers serialize events belonging to the same set.
+func (w *Watcher) work() {
+	for name := range w.queue {
+		w.mu.RLock()
+		if err := w.handle(w.ctx, name); err != nil {
+			log.Print(err)
+			if errors.Is(err, fsutil.ErrInsufficientSpace) || errors.Is(err, fsutil.ErrChanging) {
+				w.retry(name)
+			}
+		}
+		w.mu.RUnlock()
+	}
+}
+
 func (w *Watcher) goServe() {
-	w.wg.Add(2)
+	w.wg.Add(2 + w.workers)
 	go func() {
 		defer w.wg.Done()
 		w.readSignal()
@@ -153,16 +312,26 @@ func (w *Watcher) goServe() {
 		defer w.wg.Done()
 		w.readEvent()
 	}()
+	// Handle events concurrently, using a fixed number of workers
+	for i := 0; i < w.workers; i++ {
+		go func() {
+			defer w.wg.Done()
+			w.work()
+		}()
+	}
 }
 
 func (w *Watcher) Start() {
+	w.cleanup()
 	w.goServe()
 	w.watch()
 	w.wg.Wait()
 }
 
 func (w *Watcher) Stop() {
+	w.cancel()
 	notify.Stop(w.events)
+	w.stopRetries()
 	w.done <- true
 	w.done <- true
 }
@@ -170,13 +339,25 @@ func (w *Watcher) Stop() {
 func New(cfg Config) *Watcher {
 	// Buffer events so that we don't miss any
 	events := make(chan notify.EventInfo, cfg.BufferSize)
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
 	sig := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
 	signal.Notify(sig)
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Watcher{
-		config: cfg,
-		events: events,
-		signal: sig,
-		done:   done,
+		config:     cfg,
+		events:     events,
+		queue:      make(chan string),
+		workers:    workers,
+		signal:     sig,
+		done:       done,
+		retryDelay: time.Duration(cfg.RetryDelay) * time.Second,
+		retries:    make(map[string]*time.Timer),
+		ctx:        ctx,
+		cancel:     cancel,
+		progress:   make(map[string]progress.Progress),
 	}
 }
@@ -1,22 +1,29 @@
 package watcher
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/progress"
 )
 
 type testHandler struct {
 	wantFile string
 	files    []string
+	closed   bool
 }
 
-func (h *testHandler) Handle(filename, postCommand string, remove bool) error {
+func (h *testHandler) Handle(ctx context.Context, filename, postCommand string, remove bool) error {
 	if h.wantFile != "" && filename != h.wantFile {
 		return fmt.Errorf("unhandled file: %q", filename)
 	}
@@ -26,6 +33,8 @@ func (h *testHandler) Handle(filename, postCommand string, remove bool) error {
 
 func (h *testHandler) Stop() {}
 
+func (h *testHandler) Close() { h.closed = true }
+
 func (h *testHandler) awaitFile(file string) (bool, error) {
 	ts := time.Now()
 	for len(h.files) == 0 {
@@ -37,9 +46,57 @@ func (h *testHandler) awaitFile(file string) (bool, error) {
 	return h.files[0] == file, nil
 }
 
+type retryHandler struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (h *retryHandler) Handle(ctx context.Context, filename, postCommand string, remove bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls++
+	if h.calls == 1 {
+		return fmt.Errorf("unpacking failed: %w", fsutil.ErrInsufficientSpace)
+	}
+	return nil
+}
+
+func (h *retryHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+type blockingHandler struct {
+	started chan bool
+	err     chan error
+}
+
+func (h *blockingHandler) Handle(ctx context.Context, filename, postCommand string, remove bool) error {
+	h.started <- true
+	<-ctx.Done()
+	h.err <- ctx.Err()
+	return ctx.Err()
+}
+
+type progressHandler struct {
+	w        *Watcher
+	progress []progress.Progress
+}
+
+func (h *progressHandler) Handle(ctx context.Context, filename, postCommand string, remove bool) error {
+	ctx = progress.Start(ctx, filename, 3)
+	if _, err := io.Copy(io.Discard, progress.Reader(ctx, strings.NewReader("foo"))); err != nil {
+		return err
+	}
+	h.progress = h.w.Progress()
+	return nil
+}
+
 func testWatcher(dir string, handler Handler) *Watcher {
 	cfg := Config{
 		BufferSize: 10,
+		Workers:    2,
 		Paths:      []Path{{handler: handler, Name: dir, MaxDepth: 100, Patterns: []string{"*"}}},
 	}
 	log.SetOutput(io.Discard)
@@ -72,6 +129,99 @@ func TestWatching(t *testing.T) {
 	}
 }
 
+func TestRetrying(t *testing.T) {
+	dir := t.TempDir()
+	h := &retryHandler{}
+	w := testWatcher(dir, h)
+	w.retryDelay = 10 * time.Millisecond
+	defer w.Stop()
+	w.goServe()
+
+	w.events <- retryEvent{filepath.Join(dir, "foo")}
+
+	ts := time.Now()
+	for h.count() < 2 {
+		time.Sleep(10 * time.Millisecond)
+		if time.Since(ts) > 2*time.Second {
+			t.Fatalf("timed out waiting for retry, got %d calls", h.count())
+		}
+	}
+}
+
+func TestCancelling(t *testing.T) {
+	h := &blockingHandler{started: make(chan bool, 1), err: make(chan error, 1)}
+	w := testWatcher(t.TempDir(), h)
+	w.goServe()
+
+	w.events <- retryEvent{filepath.Join(w.config.Paths[0].Name, "foo")}
+	<-h.started
+
+	// TERM interrupts the running handler
+	w.signal <- syscall.SIGTERM
+	select {
+	case err := <-h.err:
+		if err != context.Canceled {
+			t.Errorf("want %q, got %q", context.Canceled, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for handler to be cancelled")
+	}
+	w.wg.Wait()
+}
+
+func TestProgress(t *testing.T) {
+	dir := t.TempDir()
+	h := &progressHandler{}
+	w := testWatcher(dir, h)
+	h.w = w
+
+	f := filepath.Join(dir, "foo")
+	if err := w.handle(w.ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.progress) != 1 {
+		t.Fatalf("want 1 progress while handling, got %d", len(h.progress))
+	}
+	if p := h.progress[0]; p.Name != f || p.Done != 3 || p.Total != 3 {
+		t.Errorf("want %s 3/3, got %s %d/%d", f, p.Name, p.Done, p.Total)
+	}
+	if got := w.Progress(); len(got) != 0 {
+		t.Errorf("want no progress after handling, got %d", len(got))
+	}
+}
+
+func TestHandleStaging(t *testing.T) {
+	dir := t.TempDir()
+	h := &testHandler{}
+	w := testWatcher(dir, h)
+	name := filepath.Join(dir, ".unp-staging-123", "foo.rar")
+	if err := w.handle(w.ctx, name); err == nil || err.Error() != "staging path: "+name {
+		t.Errorf("want error for staging path, got %v", err)
+	}
+	if len(h.files) != 0 {
+		t.Errorf("want no files handled, got %d", len(h.files))
+	}
+}
+
+func TestConcurrentHandling(t *testing.T) {
+	h := &blockingHandler{started: make(chan bool, 2), err: make(chan error, 2)}
+	w := testWatcher(t.TempDir(), h)
+	defer w.Stop()
+	w.goServe()
+
+	// A blocked handler does not prevent other events from being handled
+	for _, name := range []string{"foo", "bar"} {
+		w.events <- retryEvent{filepath.Join(w.config.Paths[0].Name, name)}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-h.started:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for handler %d", i+1)
+		}
+	}
+}
+
 func TestRescanning(t *testing.T) {
 	dir := t.TempDir()
 
@@ -121,6 +271,8 @@ func TestReloading(t *testing.T) {
 	// Start serving with empty config
 	w.goServe()
 	w.watch()
+	old := &testHandler{}
+	w.config.Paths = []Path{{handler: old}}
 
 	// Create a new directory
 	dir, err := filepath.EvalSymlinks(t.TempDir())
@@ -139,12 +291,15 @@ func TestReloading(t *testing.T) {
 
 	// Wait until config is loaded
 	ts := time.Now()
-	for len(w.config.Paths) == 0 {
+	for len(w.config.Paths) == 0 || w.config.Paths[0].handler == old {
 		time.Sleep(10 * time.Millisecond)
 		if time.Since(ts) > 2*time.Second {
 			t.Fatal("timed out waiting for new config")
 		}
 	}
+	if !old.closed {
+		t.Error("want handler of replaced config to be closed")
+	}
 
 	// Override handler
 	w.config.Paths[0].handler = h
@@ -161,3 +316,28 @@ func TestReloading(t *testing.T) {
 		t.Errorf("want %s, got %s", f, files[0])
 	}
 }
+
+func TestForce(t *testing.T) {
+	dir := t.TempDir()
+	h := &testHandler{}
+	w := testWatcher(dir, h)
+
+	f1 := filepath.Join(dir, "foo")
+	f2 := filepath.Join(dir, "sub", "bar")
+	if err := os.MkdirAll(filepath.Dir(f2), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{f1, f2} {
+		if err := os.WriteFile(f, []byte{0}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Directories are walked, and files are handled once without running the watcher
+	if err := w.Force(context.Background(), filepath.Dir(f2), f1); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{f2, f1}, h.files; strings.Join(want, ",") != strings.Join(got, ",") {
+		t.Errorf("want files %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,392 @@
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+const (
+	directoryEndSignature    = 0x06054b50
+	directory64LocSignature  = 0x07064b50
+	directory64EndSignature  = 0x06064b50
+	directoryHeaderSignature = 0x02014b50
+
+	directoryEndLen    = 22
+	directory64LocLen  = 20
+	directory64EndLen  = 56
+	directoryHeaderLen = 46
+
+	zip64ExtraID = 0x0001
+	// maxCommentLen is the maximum length of the comment trailing the end of central directory record.
+	maxCommentLen = 0xffff
+)
+
+var (
+	// zipSpannedRE matches volumes of a set created with zip -s, where the last volume is named .zip and the
+	// preceding ones .z01, .z02 and so on.
+	zipSpannedRE = regexp.MustCompile(`\.(zip|z\d\d+)$`)
+	// zipSplitRE matches parts of a zip file that has been split into pieces of equal size, named .zip.001,
+	// .zip.002 and so on.
+	zipSplitRE = regexp.MustCompile(`\.zip\.(\d{3,})$`)
+)
+
+// setName returns the name identifying the zip set that the volume name belongs to. This is the .zip file of a
+// spanned set, and the first part of a split one.
+func setName(name string) (string, error) {
+	if m := zipSplitRE.FindStringSubmatchIndex(name); m != nil {
+		lo, hi := m[2], m[3]
+		return name[:lo] + fmt.Sprintf("%0*d", hi-lo, 1), nil
+	}
+	if m := zipSpannedRE.FindStringIndex(name); m != nil {
+		return name[:m[0]] + ".zip", nil
+	}
+	return "", fmt.Errorf("not a zip volume: %s", name)
+}
+
+// partName returns the name of part n, counting from zero, of the split zip set starting with the part first.
+func partName(first string, n int) string {
+	m := zipSplitRE.FindStringSubmatchIndex(first)
+	lo, hi := m[2], m[3]
+	return first[:lo] + fmt.Sprintf("%0*d", hi-lo, n+1)
+}
+
+// diskName returns the name of disk n, counting from zero, of the spanned zip set whose last disk is name.
+func diskName(name string, n int) string {
+	return name[:len(name)-len("zip")] + "z" + fmt.Sprintf("%02d", n+1)
+}
+
+// volumeSet is a zip set opened for reading. Reading from a volumeSet reads a single zip file, regardless of how many
+// volumes the set consists of.
+type volumeSet struct {
+	io.ReaderAt
+	size    int64
+	volumes []string
+	files   []*os.File
+}
+
+func (s *volumeSet) Close() error {
+	var err error
+	for _, f := range s.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// part is a section of a multiReaderAt.
+type part struct {
+	r      io.ReaderAt
+	offset int64
+	size   int64
+}
+
+// multiReaderAt is the logical concatenation of its parts.
+type multiReaderAt []part
+
+func (m multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, pt := range m {
+		if len(p) == 0 {
+			break
+		}
+		if off >= pt.offset+pt.size {
+			continue
+		}
+		rel := off - pt.offset
+		want := len(p)
+		if remaining := pt.size - rel; int64(want) > remaining {
+			want = int(remaining)
+		}
+		k, err := pt.r.ReadAt(p[:want], rel)
+		n += k
+		off += int64(k)
+		p = p[k:]
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if k < want {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// openVolumes opens the zip set identified by name, as returned by setName. An error is returned if any volume is
+// missing.
+func openVolumes(name string) (*volumeSet, error) {
+	s := &volumeSet{}
+	var parts multiReaderAt
+	var size int64
+	add := func(volume string) error {
+		f, err := os.Open(volume)
+		if err != nil {
+			return err
+		}
+		s.files = append(s.files, f)
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		s.volumes = append(s.volumes, volume)
+		parts = append(parts, part{r: f, offset: size, size: fi.Size()})
+		size += fi.Size()
+		return nil
+	}
+	if zipSplitRE.MatchString(name) {
+		// Parts of a split zip are read until the first missing one. If any trailing parts are missing, the end of
+		// central directory record is missing too
+		for i := 0; ; i++ {
+			err := add(partName(name, i))
+			if i > 0 && os.IsNotExist(err) {
+				break
+			}
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		s.ReaderAt, s.size = parts, size
+		return s, nil
+	}
+	last, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	end, err := readDirectoryEnd(last)
+	last.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	for i := 0; i < int(end.disk); i++ {
+		if err := add(diskName(name, i)); err != nil {
+			s.Close()
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("missing volume %d of %d: %w", i+1, end.disk+1, err)
+			}
+			return nil, err
+		}
+	}
+	if err := add(name); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if end.disk == 0 {
+		s.ReaderAt, s.size = parts, size
+		return s, nil
+	}
+	// Offsets in a spanned set are relative to the disk they refer to, so they are rewritten to be relative to the
+	// concatenated volumes
+	trailer, err := rewriteDirectory(parts, end)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	s.ReaderAt = append(parts, part{r: bytes.NewReader(trailer), offset: size, size: int64(len(trailer))})
+	s.size = size + int64(len(trailer))
+	return s, nil
+}
+
+// directoryEnd is the end of central directory record of a zip set.
+type directoryEnd struct {
+	disk      uint32 // Number of the disk containing this record
+	dirDisk   uint32 // Number of the disk where the central directory starts
+	dirSize   uint64
+	dirOffset uint64 // Offset of the central directory, relative to dirDisk
+}
+
+// readDirectoryEnd reads the end of central directory record from the last volume of a zip set.
+func readDirectoryEnd(f *os.File) (directoryEnd, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return directoryEnd{}, err
+	}
+	size := fi.Size()
+	n := int64(directoryEndLen + maxCommentLen)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, size-n); err != nil {
+		return directoryEnd{}, err
+	}
+	p := -1
+	for i := len(buf) - directoryEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == directoryEndSignature &&
+			i+directoryEndLen+int(binary.LittleEndian.Uint16(buf[i+20:])) <= len(buf) {
+			p = i
+			break
+		}
+	}
+	if p < 0 {
+		return directoryEnd{}, errors.New("end of central directory not found")
+	}
+	b := buf[p:]
+	end := directoryEnd{
+		disk:      uint32(binary.LittleEndian.Uint16(b[4:])),
+		dirDisk:   uint32(binary.LittleEndian.Uint16(b[6:])),
+		dirSize:   uint64(binary.LittleEndian.Uint32(b[12:])),
+		dirOffset: uint64(binary.LittleEndian.Uint32(b[16:])),
+	}
+	// The zip64 record, if any, is located through the locator preceding the end of central directory record
+	offset := size - n + int64(p)
+	if offset < directory64LocLen {
+		return end, nil
+	}
+	loc := make([]byte, directory64LocLen)
+	if _, err := f.ReadAt(loc, offset-directory64LocLen); err != nil {
+		return directoryEnd{}, err
+	}
+	if binary.LittleEndian.Uint32(loc) != directory64LocSignature {
+		return end, nil
+	}
+	if disk := binary.LittleEndian.Uint32(loc[4:]); disk != end.disk && end.disk != 0xffff {
+		return directoryEnd{}, errors.New("zip64 end of central directory is not on the last disk")
+	}
+	rec := make([]byte, directory64EndLen)
+	if _, err := f.ReadAt(rec, int64(binary.LittleEndian.Uint64(loc[8:]))); err != nil {
+		return directoryEnd{}, err
+	}
+	if binary.LittleEndian.Uint32(rec) != directory64EndSignature {
+		return directoryEnd{}, errors.New("invalid zip64 end of central directory")
+	}
+	return directoryEnd{
+		disk:      binary.LittleEndian.Uint32(rec[16:]),
+		dirDisk:   binary.LittleEndian.Uint32(rec[20:]),
+		dirSize:   binary.LittleEndian.Uint64(rec[40:]),
+		dirOffset: binary.LittleEndian.Uint64(rec[48:]),
+	}, nil
+}
+
+// rewriteDirectory reads the central directory of the spanned set consisting of disks, and returns a copy where all
+// offsets are relative to the start of the first disk. The copy is followed by zip64 end of central directory records
+// describing it, as if it were appended to the concatenated disks.
+func rewriteDirectory(disks multiReaderAt, end directoryEnd) ([]byte, error) {
+	if int(end.dirDisk) >= len(disks) {
+		return nil, fmt.Errorf("invalid central directory disk: %d", end.dirDisk)
+	}
+	dir := make([]byte, end.dirSize)
+	if _, err := disks.ReadAt(dir, disks[end.dirDisk].offset+int64(end.dirOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read central directory: %w", err)
+	}
+	var out bytes.Buffer
+	records := uint64(0)
+	for b := dir; len(b) > 0; records++ {
+		if len(b) < directoryHeaderLen || binary.LittleEndian.Uint32(b) != directoryHeaderSignature {
+			return nil, errors.New("invalid central directory")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(b[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(b[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(b[32:]))
+		n := directoryHeaderLen + nameLen + extraLen + commentLen
+		if len(b) < n {
+			return nil, errors.New("invalid central directory")
+		}
+		header, err := rewriteHeader(b[:n], disks)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(header)
+		b = b[n:]
+	}
+	dirOffset := uint64(disks[len(disks)-1].offset + disks[len(disks)-1].size)
+	dirSize := uint64(out.Len())
+	le := binary.LittleEndian
+	rec := make([]byte, directory64EndLen)
+	le.PutUint32(rec, directory64EndSignature)
+	le.PutUint64(rec[4:], directory64EndLen-12)
+	le.PutUint16(rec[12:], 45) // Version made by
+	le.PutUint16(rec[14:], 45) // Version needed to extract
+	le.PutUint64(rec[24:], records)
+	le.PutUint64(rec[32:], records)
+	le.PutUint64(rec[40:], dirSize)
+	le.PutUint64(rec[48:], dirOffset)
+	out.Write(rec)
+	loc := make([]byte, directory64LocLen)
+	le.PutUint32(loc, directory64LocSignature)
+	le.PutUint64(loc[8:], dirOffset+dirSize)
+	le.PutUint32(loc[16:], 1) // Total number of disks
+	out.Write(loc)
+	eocd := make([]byte, directoryEndLen)
+	le.PutUint32(eocd, directoryEndSignature)
+	le.PutUint16(eocd[8:], 0xffff)
+	le.PutUint16(eocd[10:], 0xffff)
+	le.PutUint32(eocd[12:], 0xffffffff)
+	le.PutUint32(eocd[16:], 0xffffffff)
+	out.Write(eocd)
+	return out.Bytes(), nil
+}
+
+// rewriteHeader returns a copy of the central directory header b, with its local header offset made relative to the
+// start of the first disk.
+func rewriteHeader(b []byte, disks multiReaderAt) ([]byte, error) {
+	le := binary.LittleEndian
+	header := append([]byte(nil), b...)
+	nameLen := int(le.Uint16(header[28:]))
+	extraLen := int(le.Uint16(header[30:]))
+	disk := uint32(le.Uint16(header[34:]))
+	offset := uint64(le.Uint32(header[42:]))
+	// Values that do not fit are stored in the zip64 extra field, in this order
+	var offsetAt int
+	extra := header[directoryHeaderLen+nameLen : directoryHeaderLen+nameLen+extraLen]
+	for e := extra; len(e) >= 4; {
+		id, size := le.Uint16(e), int(le.Uint16(e[2:]))
+		if len(e) < 4+size {
+			break
+		}
+		if id == zip64ExtraID {
+			field := e[4 : 4+size]
+			pos := 0
+			next := func() bool { return pos+8 <= len(field) }
+			if le.Uint32(header[24:]) == 0xffffffff && next() {
+				pos += 8 // Uncompressed size
+			}
+			if le.Uint32(header[20:]) == 0xffffffff && next() {
+				pos += 8 // Compressed size
+			}
+			if offset == 0xffffffff && next() {
+				offset = le.Uint64(field[pos:])
+				offsetAt = directoryHeaderLen + nameLen + len(extra) - len(e) + 4 + pos
+				pos += 8
+			}
+			if disk == 0xffff && pos+4 <= len(field) {
+				disk = le.Uint32(field[pos:])
+			}
+			break
+		}
+		e = e[4+size:]
+	}
+	if int(disk) >= len(disks) {
+		return nil, fmt.Errorf("invalid disk number: %d", disk)
+	}
+	abs := uint64(disks[disk].offset) + offset
+	le.PutUint16(header[34:], 0)
+	switch {
+	case offsetAt > 0:
+		le.PutUint64(header[offsetAt:], abs)
+	case abs < 0xffffffff:
+		le.PutUint32(header[42:], uint32(abs))
+	default:
+		// Offset no longer fits, so it is moved to an additional zip64 extra field
+		if extraLen+12 > 0xffff {
+			return nil, errors.New("extra field too large")
+		}
+		field := make([]byte, 12)
+		le.PutUint16(field, zip64ExtraID)
+		le.PutUint16(field[2:], 8)
+		le.PutUint64(field[4:], abs)
+		end := directoryHeaderLen + nameLen + extraLen
+		header = append(header[:end], append(field, b[end:]...)...)
+		le.PutUint16(header[30:], uint16(extraLen+12))
+		le.PutUint32(header[42:], 0xffffffff)
+	}
+	return header, nil
+}
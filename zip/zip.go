@@ -0,0 +1,332 @@
+package zip
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mpolden/sfv"
+	"github.com/mpolden/unp/executil"
+	"github.com/mpolden/unp/fsutil"
+	"github.com/mpolden/unp/manifest"
+	"github.com/mpolden/unp/pathutil"
+	"github.com/mpolden/unp/progress"
+	"github.com/mpolden/unp/sfvutil"
+	"github.com/mpolden/unp/syncutil"
+	"github.com/mpolden/unp/unpack"
+)
+
+const (
+	// creatorUnix is the host system of entries created on Unix systems.
+	creatorUnix = 3
+	// flagEncrypted is set in the flags of encrypted entries.
+	flagEncrypted = 0x1
+)
+
+// Options configures how a Handler unpacks archives.
+type Options struct {
+	unpack.Options
+	unpack.VerifyOptions
+}
+
+// Handler unpacks zip archives, including split and spanned sets.
+type Handler struct {
+	locks syncutil.KeyMutex
+	cache *sfvutil.Cache
+	opts  Options
+}
+
+func findZip(s *sfv.SFV) (string, error) {
+	for _, c := range s.Checksums {
+		if name, err := setName(c.Path); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no zip found in %s", s.Path)
+}
+
+// eventFrom returns the set that filename belongs to. The set is described by a SFV if one lists it, and by the zip
+// itself otherwise.
+func eventFrom(filename string) (unpack.Set, error) {
+	dir := filepath.Dir(filename)
+	sfvs, err := sfvutil.ReadDir(dir)
+	if err != nil {
+		return unpack.Set{}, err
+	}
+	var name string
+	s := sfvutil.Find(filename, sfvs, setName)
+	if s != nil {
+		name, err = findZip(s)
+	} else {
+		name, err = setName(filename)
+	}
+	if err != nil {
+		return unpack.Set{}, err
+	}
+	return unpack.Set{
+		SFV:  s,
+		Base: filepath.Base(name),
+		Dir:  dir,
+		Name: name,
+	}, nil
+}
+
+func NewHandler(opts Options) *Handler {
+	return &Handler{cache: opts.LoadCache(), opts: opts}
+}
+
+// Close stops pruning the verification cache of the handler.
+func (h *Handler) Close() { h.cache.Close() }
+
+// checkEntries returns an error if the data of any entry in r is missing. Entries are located through the central
+// directory, and each must start with a valid local header and end within the set.
+func checkEntries(r *zip.Reader, size int64) error {
+	for _, f := range r.File {
+		offset, err := f.DataOffset()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if offset+int64(f.CompressedSize64) > size {
+			return fmt.Errorf("%s: %w", f.Name, io.ErrUnexpectedEOF)
+		}
+	}
+	return nil
+}
+
+// copyEntry copies the contents of f from r to w. Contents are hashed by archive/zip while being read, and compared
+// to the CRC32 stored in the central directory once the end of the entry is reached. The number of bytes copied and
+// their CRC32 is returned.
+func copyEntry(ctx context.Context, w io.Writer, r io.Reader, f *zip.File) (int64, uint32, error) {
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, hash), unpack.Reader(ctx, r))
+	if errors.Is(err, zip.ErrChecksum) {
+		return 0, 0, fmt.Errorf("checksum mismatch: %s: %w", f.Name, err)
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+	}
+	return n, hash.Sum32(), nil
+}
+
+func isSymlink(f *zip.File) bool { return f.Mode()&fs.ModeSymlink != 0 }
+
+// chmod sets the permission bits of name to the ones stored in f, if f was created on a Unix system. Directories
+// always remain accessible to their owner, so that they can be written to and published.
+func chmod(name string, f *zip.File) error {
+	if f.CreatorVersion>>8 != creatorUnix {
+		return nil
+	}
+	mode := f.Mode().Perm()
+	if f.FileInfo().IsDir() {
+		mode |= 0700
+	}
+	return os.Chmod(name, mode)
+}
+
+func chtimes(name string, f *zip.File) error {
+	if f.Modified.IsZero() {
+		return nil
+	}
+	return os.Chtimes(name, f.Modified, f.Modified)
+}
+
+// unpackFile unpacks the entry f, which is written to name. The entry is opened only once it is known to be unpacked.
+func (h *Handler) unpackFile(ctx context.Context, f *zip.File, name string) (int64, uint32, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+	out, err := os.Create(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create file: %s: %w", name, err)
+	}
+	n, crc, err := copyEntry(ctx, out, rc, f)
+	if err != nil {
+		out.Close()
+		return 0, 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, 0, err
+	}
+	return n, crc, nil
+}
+
+// unpack unpacks the zip read by r to dir. Existing files in dest, which is the directory that dir is eventually
+// published to, are handled according to the overwrite policy. The regular files that were unpacked are returned,
+// relative to dir.
+func (h *Handler) unpack(ctx context.Context, r *zip.Reader, filename, dir, dest string) ([]manifest.Entry, error) {
+	var files []manifest.Entry
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if h.opts.Skip(f.Name) {
+			continue
+		}
+		if f.Flags&flagEncrypted != 0 {
+			return nil, fmt.Errorf("failed to unpack %s: encrypted entries are not supported", f.Name)
+		}
+		name, err := pathutil.Join(dir, f.Name)
+		if err != nil {
+			if err := h.opts.Unsafe(filename, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// If entry is a directory, create it and set correct ctime
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return nil, err
+			}
+			if h.opts.PreserveMode {
+				if err := chmod(name, f); err != nil {
+					return nil, err
+				}
+			}
+			if err := chtimes(name, f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var symlinkTo string
+		// Without Symlinks, the link target is unpacked as file contents, which is safe wherever it points
+		if isSymlink(f) && h.opts.Symlinks {
+			// Symbolic links store their target as the file contents
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+			}
+			target, err := io.ReadAll(io.LimitReader(rc, unpack.MaxLinkSize))
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+			}
+			if err := unpack.CheckSymlink(dir, name, string(target)); err != nil {
+				if err := h.opts.Unsafe(filename, fmt.Errorf("%s: %w", f.Name, err)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			symlinkTo = string(target)
+		}
+		name, err = h.opts.Target(dir, dest, name, f.Name, f.Modified)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		if symlinkTo != "" {
+			if err := unpack.Link(name, symlinkTo, ""); err != nil {
+				return nil, fmt.Errorf("failed to unpack %s: %w", f.Name, err)
+			}
+			continue
+		}
+		// Unpack file
+		progress.SetEntry(ctx, f.Name)
+		n, crc, err := h.unpackFile(ctx, f, name)
+		if err != nil {
+			return nil, err
+		}
+		if h.opts.PreserveMode {
+			if err := chmod(name, f); err != nil {
+				return nil, err
+			}
+		}
+		// Set correct ctime of unpacked file
+		if err := chtimes(name, f); err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, manifest.Entry{Name: filepath.ToSlash(rel), Size: n, CRC32: fmt.Sprintf("%08x", crc)})
+	}
+	return files, nil
+}
+
+// extract unpacks the zip read by r to dest, through a staging directory.
+func (h *Handler) extract(ctx context.Context, r *zip.Reader, filename, dest string) ([]manifest.Entry, error) {
+	return h.opts.Staged(dest, func(dir string) ([]manifest.Entry, error) {
+		return h.unpack(ctx, r, filename, dir, dest)
+	})
+}
+
+// unpackedSize returns the total size of the entries in r that are not skipped.
+func (h *Handler) unpackedSize(r *zip.Reader) int64 {
+	var size int64
+	for _, f := range r.File {
+		if !h.opts.Skip(f.Name) {
+			size += int64(f.UncompressedSize64)
+		}
+	}
+	return size
+}
+
+func (h *Handler) Handle(ctx context.Context, name, postCommand string, removeZips bool) error {
+	ev, err := eventFrom(name)
+	if err != nil {
+		return err
+	}
+	defer h.locks.Lock(ev.Key())()
+	cd := ev.CommandData()
+	dest, err := h.opts.Dest(cd)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %s: %w", ev.Dir, err)
+	}
+	if manifest.Unpacked(ctx, dest, ev.Name) {
+		return nil
+	}
+	if err := ev.Verify(ctx, h.cache, h.opts.VerifyWorkers); err != nil {
+		return err
+	}
+	// Without a SFV, the set is complete when all volumes are present and the central directory locates the data of
+	// every entry. Entry checksums are verified while unpacking
+	vs, err := openVolumes(ev.Name)
+	if err != nil {
+		return fmt.Errorf("incomplete: %s: %w", ev.Dir, err)
+	}
+	defer vs.Close()
+	ev.Volumes = vs.volumes
+	r, err := zip.NewReader(vs, vs.size)
+	if err != nil {
+		return fmt.Errorf("incomplete: %s: %s: %w", ev.Dir, ev.Base, err)
+	}
+	if err := checkEntries(r, vs.size); err != nil {
+		return fmt.Errorf("incomplete: %s: %s: %w", ev.Dir, ev.Base, err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
+	}
+	size := h.unpackedSize(r)
+	if err := fsutil.CheckSpace(dest, size, h.opts.ReserveSpace); err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
+	}
+	ctx = progress.Start(ctx, ev.Name, size)
+	files, err := h.extract(ctx, r, ev.Name, dest)
+	vs.Close()
+	if err != nil {
+		return fmt.Errorf("unpacking failed: %s: %w", ev.Dir, err)
+	}
+	if err := manifest.Record(dest, ev.Name, ev.Sources(), files); err != nil {
+		log.Printf("failed to write manifest: %s: %s", dest, err)
+	}
+	ev.Forget(h.cache)
+	if removeZips {
+		if err := ev.Remove(); err != nil {
+			return fmt.Errorf("removal failed: %s: %w", ev.Dir, err)
+		}
+	}
+	if err := executil.Run(ctx, postCommand, cd); err != nil {
+		return fmt.Errorf("post-process command failed: %s: %w", ev.Dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package zip
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpolden/unp/unpack"
+)
+
+func testDir(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(wd, "testdata")
+}
+
+func symlink(t *testing.T, oldname, newname string) {
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func writeZip(t *testing.T, name string, entries map[string]string) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, data := range entries {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetName(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"foo.zip", "foo.zip"},
+		{"foo.z01", "foo.zip"},
+		{"foo.z42", "foo.zip"},
+		{"foo.z100", "foo.zip"},
+		{"foo.zip.001", "foo.zip.001"},
+		{"foo.zip.002", "foo.zip.001"},
+		{"foo.zip.0010", "foo.zip.0001"},
+		{"foo.rar", ""},
+		{"foo.zip.1", ""},
+		{"foo.nfo", ""},
+	}
+	for i, tt := range tests {
+		got, err := setName(tt.in)
+		if tt.out == "" {
+			if err == nil {
+				t.Errorf("#%d: want error for %s", i, tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if got != tt.out {
+			t.Errorf("#%d: want %s, got %s", i, tt.out, got)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+		zf  = filepath.Join(dir, "test.zip")
+		out = filepath.Join(dir, "post")
+	)
+	symlink(t, filepath.Join(td, "test.zip"), zf)
+
+	script := filepath.Join(t.TempDir(), "post.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Options{Options: unpack.Options{PreserveMode: true}})
+	post := script + " {{.Name}} {{.Base}} {{.Dir}}"
+	if err := h.Handle(context.Background(), zf, post, true); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		file string
+		data string
+		mode os.FileMode
+	}{
+		{"test1", "test1\n", 0640},
+		{"test/test2", "test2\n", 0644},
+		{"link", "test1", 0644}, // Symbolic link is unpacked as a file containing the target
+	}
+	for i, tt := range tests {
+		name := filepath.Join(dir, filepath.FromSlash(tt.file))
+		if got := readFile(t, name); got != tt.data {
+			t.Errorf("#%d: want %q, got %q", i, tt.data, got)
+		}
+		fi, err := os.Lstat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); i < 2 && got != tt.mode {
+			t.Errorf("#%d: want mode %o, got %o", i, tt.mode, got)
+		}
+		if want, got := 2020, fi.ModTime().Year(); want != got {
+			t.Errorf("#%d: want mtime in %d, got %d", i, want, got)
+		}
+	}
+	if want, got := fmt.Sprintf("%s test.zip %s\n", zf, dir), readFile(t, out); want != got {
+		t.Errorf("want post-command output %q, got %q", want, got)
+	}
+	if _, err := os.Lstat(zf); !os.IsNotExist(err) {
+		t.Errorf("want %s to be removed", zf)
+	}
+}
+
+func TestHandleSpanned(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+		z01 = filepath.Join(dir, "spanned.z01")
+		zf  = filepath.Join(dir, "spanned.zip")
+	)
+	symlink(t, filepath.Join(td, "spanned.zip"), zf)
+
+	h := NewHandler(Options{})
+	if err := h.Handle(context.Background(), zf, "", true); err == nil || !strings.HasPrefix(err.Error(), "incomplete: "+dir) {
+		t.Errorf("want incomplete error, got %v", err)
+	}
+
+	symlink(t, filepath.Join(td, "spanned.z01"), z01)
+	if err := h.Handle(context.Background(), z01, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "test2\n", readFile(t, filepath.Join(dir, "test", "test2")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := strings.Repeat("test3\n", 70000/6)+"test", readFile(t, filepath.Join(dir, "test", "test3")); want != got {
+		t.Errorf("want %d bytes, got %d", len(want), len(got))
+	}
+	for _, name := range []string{z01, zf} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed", name)
+		}
+	}
+}
+
+func TestHandleSplit(t *testing.T) {
+	var (
+		td   = testDir(t)
+		dir  = t.TempDir()
+		data = readFile(t, filepath.Join(td, "test.zip"))
+		n    = len(data) / 3
+	)
+	parts := []string{data[:n], data[n : 2*n], data[2*n:]}
+	for i, part := range parts[:2] {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("test.zip.%03d", i+1)), []byte(part), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewHandler(Options{})
+	if err := h.Handle(context.Background(), filepath.Join(dir, "test.zip.002"), "", false); err == nil || !strings.HasPrefix(err.Error(), "incomplete: "+dir) {
+		t.Errorf("want incomplete error, got %v", err)
+	}
+
+	last := filepath.Join(dir, "test.zip.003")
+	if err := os.WriteFile(last, []byte(parts[2]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Handle(context.Background(), last, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "test1\n", readFile(t, filepath.Join(dir, "test1")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestHandleSFV(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+		zf  = filepath.Join(dir, "test.zip")
+	)
+	data := readFile(t, filepath.Join(td, "test.zip"))
+	sfvFile := filepath.Join(dir, "test.sfv")
+	if err := os.WriteFile(sfvFile, []byte(fmt.Sprintf("test.zip %08x\n", crc32.ChecksumIEEE([]byte(data)))), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Options{})
+	want := "incomplete: " + dir + ": 0/1 files"
+	if err := h.Handle(context.Background(), sfvFile, "", false); err == nil || err.Error() != want {
+		t.Errorf("want err = %q, got %v", want, err)
+	}
+
+	if err := os.WriteFile(zf, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Handle(context.Background(), sfvFile, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "test1\n", readFile(t, filepath.Join(dir, "test1")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	for _, name := range []string{zf, sfvFile} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed", name)
+		}
+	}
+}
+
+func TestHandleChecksumMismatch(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+		zf  = filepath.Join(dir, "test.zip")
+	)
+	data := []byte(readFile(t, filepath.Join(td, "test.zip")))
+	// Corrupt the contents of the first entry, which is stored uncompressed
+	i := strings.Index(string(data), "test1\n")
+	data[i] = 'x'
+	if err := os.WriteFile(zf, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(Options{})
+	err := h.Handle(context.Background(), zf, "", false)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch: test1") {
+		t.Errorf("want checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test1")); !os.IsNotExist(err) {
+		t.Error("want no files to be unpacked")
+	}
+}
+
+func TestHandleUnsafe(t *testing.T) {
+	var tests = []struct {
+		name string
+		err  string
+	}{
+		{"../evil", "unsafe entry: path traversal: ../evil"},
+		{"/evil", "unsafe entry: absolute path: /evil"},
+	}
+	for i, tt := range tests {
+		for _, skip := range []bool{false, true} {
+			root := t.TempDir()
+			dir := filepath.Join(root, "a")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			zf := filepath.Join(dir, "unsafe.zip")
+			writeZip(t, zf, map[string]string{tt.name: "evil", "ok": "ok"})
+
+			h := NewHandler(Options{Options: unpack.Options{SkipUnsafe: skip}})
+			err := h.Handle(context.Background(), zf, "", false)
+			if skip {
+				if err != nil {
+					t.Fatalf("#%d: %s", i, err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "ok")); err != nil {
+					t.Errorf("#%d: want safe entry to be unpacked: %s", i, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("#%d: want err = %q, got %v", i, tt.err, err)
+			}
+			if _, err := os.Lstat(filepath.Join(root, "evil")); err == nil {
+				t.Errorf("#%d: unsafe entry unpacked", i)
+			}
+		}
+	}
+}
+
+func TestHandleOverwriteAndDestDir(t *testing.T) {
+	var (
+		td   = testDir(t)
+		dir  = t.TempDir()
+		zf   = filepath.Join(dir, "test.zip")
+		dest = filepath.Join(dir, "out", "test.zip")
+	)
+	symlink(t, filepath.Join(td, "test.zip"), zf)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(dest, "test1")
+	if err := os.WriteFile(existing, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Existing file is newer than the one in the archive
+	now := time.Now()
+	if err := os.Chtimes(existing, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Options{Options: unpack.Options{DestDir: "out/{{.Base}}", Overwrite: "never"}})
+	if err := h.Handle(context.Background(), zf, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "existing", readFile(t, existing); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "test2\n", readFile(t, filepath.Join(dest, "test", "test2")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestHandleSymlinks(t *testing.T) {
+	var (
+		td  = testDir(t)
+		dir = t.TempDir()
+		zf  = filepath.Join(dir, "test.zip")
+	)
+	symlink(t, filepath.Join(td, "test.zip"), zf)
+	h := NewHandler(Options{Options: unpack.Options{Symlinks: true}})
+	if err := h.Handle(context.Background(), zf, "", false); err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Readlink(filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "test1"; target != want {
+		t.Errorf("want link to %s, got %s", want, target)
+	}
+}